@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// hostBootID returns an ID that changes every time the host reboots, or "" if unknown.
+func hostBootID() string {
+	id, err := syscall.Sysctl("kern.bootsessionuuid")
+	if err != nil {
+		return ""
+	}
+	return id
+}
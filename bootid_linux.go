@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// hostBootID returns an ID that changes every time the host reboots, or "" if unknown.
+func hostBootID() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// hostBootID returns an ID that changes every time the host reboots, or "" if unknown.
+func hostBootID() string {
+	return ""
+}
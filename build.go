@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+	"gopkg.in/yaml.v3"
+)
+
+// buildError is returned when a profile's image could not be built, in which case there's no image to fall back on.
+type buildError struct {
+	profile string
+	err     error
+}
+
+func (e *buildError) Error() string {
+	return fmt.Sprintf("building image for profile %s: %s", e.profile, e.err)
+}
+
+func (e *buildError) Unwrap() error {
+	return e.err
+}
+
+// Hashes of build contexts, so unchanged contexts aren't read in full every time.
+const buildHashRelPath = ".cache/canon/build-hashes.yaml"
+
+// buildImage builds the image for a profile with a build section, and points the profile at it. The image is tagged
+// with a hash of the build inputs, so it's only rebuilt when they change, or when rebuild is set (which also pulls
+// newer base images.)
+func buildImage(ctx context.Context, cli *client.Client, profile *Profile, rebuild bool) (UpdateResult, error) {
+	platform := "linux/" + profile.Arch
+	result := UpdateResult{Platform: platform, Status: "failed"}
+	fail := func(err error) (UpdateResult, error) {
+		result.Error = err.Error()
+		return result, &buildError{profile: profile.name, err: err}
+	}
+
+	build := profile.Build
+	if len(build.Platforms) > 0 && !slices.Contains(build.Platforms, profile.Arch) {
+		return fail(fmt.Errorf("arch %s is not one of the build platforms %v", profile.Arch, build.Platforms))
+	}
+	dockerfile := build.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fail(err)
+	}
+	dir := expandHome(build.Context, home)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(profile.Path, dir)
+	}
+	ctxHash, err := contextHash(dir, dockerfile)
+	if err != nil {
+		return fail(err)
+	}
+
+	tag := buildTag(profile, buildHash(ctxHash, build, dockerfile, platform))
+	profile.Image = tag
+	profile.setSource("image", "built from "+dir)
+	result.Image = tag
+
+	if !rebuild {
+		info, err := localImage(ctx, cli, ImageDef{Image: tag, Platform: platform})
+		if err != nil {
+			return fail(err)
+		}
+		if info != nil {
+			result.Status = "current"
+			return result, nil
+		}
+	}
+
+	fmt.Fprintf(progressOutput(), "building image %s for profile %s from %s\n", tag, profile.name, dir)
+	buildCtx := buildContext(dir, dockerfile)
+	defer buildCtx.Close()
+	buildArgs := make(map[string]*string)
+	for k, v := range build.Args {
+		buildArgs[k] = &v
+	}
+	resp, err := cli.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  filepath.ToSlash(dockerfile),
+		BuildArgs:   buildArgs,
+		Target:      build.Target,
+		Platform:    platform,
+		PullParent:  rebuild,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	out := os.Stdout
+	if structuredOutput() {
+		out = os.Stderr
+	}
+	if err := jsonmessage.DisplayJSONMessagesStream(resp.Body, out, out.Fd(), true, nil); err != nil {
+		return fail(err)
+	}
+	result.Status = "built"
+	result.CheckedAt = time.Now()
+	return result, nil
+}
+
+// buildTag names a built image after its profile, with the arch and input hash as the tag.
+func buildTag(profile *Profile, hash string) string {
+	sanitize := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '-'
+		}
+	}
+	repo := strings.Trim(strings.Map(sanitize, strings.ToLower(profile.name)), "-")
+	if repo == "" {
+		repo = "build"
+	}
+	return fmt.Sprintf("canon-%s:%s-%s", repo, strings.ReplaceAll(profile.Arch, "/", "-"), hash[:16])
+}
+
+// buildHash hashes everything that goes into a build, the context and the build settings.
+func buildHash(ctxHash string, build BuildDef, dockerfile, platform string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "context=%s", ctxHash)
+	fmt.Fprintf(h, "\x00dockerfile=%s\x00target=%s\x00platform=%s", dockerfile, build.Target, platform)
+	var args []string
+	for k, v := range build.Args {
+		args = append(args, k+"="+v)
+	}
+	slices.Sort(args)
+	for _, a := range args {
+		fmt.Fprintf(h, "\x00arg=%s", a)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// contextHash hashes the contents of a build context, so the same files always give the same hash, whatever their
+// timestamps. Reading every file is slow for large contexts, so the hash is cached, and only recomputed when the
+// context's manifest changes.
+func contextHash(dir, dockerfile string) (string, error) {
+	manifest, err := contextManifest(dir, dockerfile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(manifest)
+	listing := hex.EncodeToString(sum[:])
+
+	key, err := filepath.Abs(filepath.Join(dir, dockerfile))
+	if err != nil {
+		return "", err
+	}
+	cache, err := readBuildHashes()
+	if err != nil {
+		// only a cache, so start over
+		cache = make(buildHashes)
+	}
+	if cached, ok := cache[key]; ok && cached.Manifest == listing {
+		return cached.Hash, nil
+	}
+
+	h := sha256.New()
+	err = walkContext(dir, dockerfile, func(path, rel, link string, info fs.FileInfo) error {
+		fmt.Fprintf(h, "%s\x00%o\x00%s\x00%d\x00", rel, info.Mode(), link, info.Size())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	cache[key] = buildHashEntry{Manifest: listing, Hash: hash}
+	printIfErr(cache.write())
+	return hash, nil
+}
+
+// contextManifest lists a build context's files with their sizes, modes, and modification times. It's much cheaper
+// than reading every file, and changes whenever the context (probably) does. Directories are listed without their
+// modification times, as those change whenever a temporary file comes and goes.
+func contextManifest(dir, dockerfile string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := walkContext(dir, dockerfile, func(_, rel, link string, info fs.FileInfo) error {
+		if info.IsDir() {
+			fmt.Fprintf(buf, "%s\x00%o\n", rel, info.Mode())
+			return nil
+		}
+		fmt.Fprintf(buf, "%s\x00%o\x00%d\x00%d\x00%s\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano(), link)
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// buildHashes records the last content hash of each build context (keyed by its Dockerfile), along with a hash of
+// its manifest at the time.
+type buildHashes map[string]buildHashEntry
+
+type buildHashEntry struct {
+	Manifest string `yaml:"manifest"`
+	Hash     string `yaml:"hash"`
+}
+
+func readBuildHashes() (buildHashes, error) {
+	hashes := make(buildHashes)
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return hashes, err
+	}
+	data, err := os.ReadFile(filepath.Join(home, buildHashRelPath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hashes, err
+	}
+	return hashes, yaml.Unmarshal(data, hashes)
+}
+
+func (hashes buildHashes) write() error {
+	out, err := yaml.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(home, buildHashRelPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// written whole and renamed into place, as other canon processes may be reading it
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, out, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// buildContext streams a tar of a build context directory, skipping files excluded by its .dockerignore. Timestamps
+// and owners are left out, so the same files always produce the same tar. Errors reading the context are returned
+// from reading the tar.
+func buildContext(dir, dockerfile string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := walkContext(dir, dockerfile, func(path, rel, link string, info fs.FileInfo) error {
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			hdr.ModTime = time.Unix(0, 0)
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.CopyN(tw, f, hdr.Size)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// walkContext calls fn for everything in a build context directory that isn't excluded by its .dockerignore, with the
+// slash separated context relative path, and the target of symlinks. Patterns are matched the same way docker does.
+func walkContext(dir, dockerfile string, fn func(path, rel, link string, info fs.FileInfo) error) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("build context: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("build context %s is not a directory", dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dockerfile)); err != nil {
+		return fmt.Errorf("build dockerfile: %w", err)
+	}
+	ignores, err := readDockerignore(dir, filepath.ToSlash(filepath.Clean(dockerfile)))
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		ignored, err := ignores.MatchesOrParentMatches(rel)
+		if err != nil {
+			return fmt.Errorf("matching .dockerignore: %w", err)
+		}
+		if ignored {
+			if d.IsDir() && !ignores.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		return fn(path, rel, link, info)
+	})
+}
+
+// readDockerignore reads the patterns from a build context's .dockerignore. Without one, nothing is ignored. As docker
+// does, the Dockerfile and .dockerignore are always sent, even if they match.
+func readDockerignore(dir, dockerfile string) (*patternmatcher.PatternMatcher, error) {
+	var patterns []string
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		defer f.Close()
+		if patterns, err = ignorefile.ReadAll(f); err != nil {
+			return nil, fmt.Errorf("reading .dockerignore: %w", err)
+		}
+	}
+	// only add exceptions when needed, as any exception means walking into every ignored directory
+	if ignored, err := patternmatcher.MatchesOrParentMatches(dockerfile, patterns); err == nil && ignored {
+		patterns = append(patterns, "!"+dockerfile, "!.dockerignore")
+	}
+	pm, err := patternmatcher.New(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("parsing .dockerignore: %w", err)
+	}
+	return pm, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeContext creates a build context containing the given files (directories when ending in /).
+func writeContext(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestWalkContext(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile":              "FROM alpine",
+		"main.go":                 "",
+		"debug.log":               "",
+		"cmd/tool/main.go":        "",
+		"cmd/tool/tool.log":       "",
+		"cmd/tool/keep.log":       "",
+		"node_modules/x/index.js": "",
+		"build/out/bin":           "",
+		"docs/":                   "",
+	}
+	tests := []struct {
+		name         string
+		dockerignore string
+		dockerfile   string
+		want         []string
+	}{
+		{
+			name: "no dockerignore",
+			want: []string{
+				"Dockerfile", "build", "build/out", "build/out/bin", "cmd", "cmd/tool", "cmd/tool/keep.log",
+				"cmd/tool/main.go", "cmd/tool/tool.log", "debug.log", "docs", "main.go", "node_modules",
+				"node_modules/x", "node_modules/x/index.js",
+			},
+		},
+		{
+			name:         "directories and double star",
+			dockerignore: "# comment\nnode_modules\n/build\n**/*.log\n",
+			want: []string{
+				".dockerignore", "Dockerfile", "cmd", "cmd/tool", "cmd/tool/main.go", "docs", "main.go",
+			},
+		},
+		{
+			name:         "exceptions",
+			dockerignore: "**/*.log\n!cmd/tool/keep.log\nbuild\n!build/out/bin\n",
+			want: []string{
+				".dockerignore", "Dockerfile", "build/out/bin", "cmd", "cmd/tool", "cmd/tool/keep.log",
+				"cmd/tool/main.go", "docs", "main.go", "node_modules", "node_modules/x", "node_modules/x/index.js",
+			},
+		},
+		{
+			name:         "dockerfile and dockerignore are always included",
+			dockerignore: "*\n",
+			dockerfile:   "cmd/tool/main.go",
+			want:         []string{".dockerignore", "cmd/tool/main.go"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeContext(t, files)
+			if tc.dockerignore != "" {
+				if err := os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(tc.dockerignore), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dockerfile := tc.dockerfile
+			if dockerfile == "" {
+				dockerfile = "Dockerfile"
+			}
+			var got []string
+			err := walkContext(dir, dockerfile, func(_, rel, _ string, _ fs.FileInfo) error {
+				got = append(got, rel)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWalkContextErrors(t *testing.T) {
+	dir := writeContext(t, map[string]string{"Dockerfile": ""})
+	noop := func(_, _, _ string, _ fs.FileInfo) error { return nil }
+	if err := walkContext(filepath.Join(dir, "missing"), "Dockerfile", noop); err == nil {
+		t.Error("expected an error for a missing context")
+	}
+	if err := walkContext(filepath.Join(dir, "Dockerfile"), "Dockerfile", noop); err == nil {
+		t.Error("expected an error for a context that is a file")
+	}
+	if err := walkContext(dir, "Dockerfile.dev", noop); err == nil {
+		t.Error("expected an error for a missing dockerfile")
+	}
+}
+
+func TestContextManifest(t *testing.T) {
+	dir := writeContext(t, map[string]string{"Dockerfile": "FROM alpine", "main.go": "package main", "out.log": ""})
+	if err := os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	manifest := func() []byte {
+		t.Helper()
+		m, err := contextManifest(dir, "Dockerfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	first := manifest()
+	if !bytes.Equal(first, manifest()) {
+		t.Error("manifest changed without any change to the context")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "out.log"), []byte("ignored"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, manifest()) {
+		t.Error("manifest changed with an ignored file")
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "main.go"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, manifest()) {
+		t.Error("manifest did not change when a file was modified")
+	}
+}
+
+func TestContextHash(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := writeContext(t, map[string]string{"Dockerfile": "FROM alpine", "main.go": "package main", "out.log": ""})
+	if err := os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		t.Helper()
+		h, err := contextHash(dir, "Dockerfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	setTime := func(name string, mtime time.Time) {
+		t.Helper()
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := hash()
+	past := time.Now().Add(-time.Hour)
+	setTime("main.go", past)
+	if hash() != first {
+		t.Error("hash changed when only a timestamp did")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "out.log"), []byte("ignored"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != first {
+		t.Error("hash changed with an ignored file")
+	}
+
+	// unchanged sizes and timestamps mean the cached hash is used, without reading the files
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package fake"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setTime("main.go", past)
+	if hash() != first {
+		t.Error("cached hash was not used for an unchanged manifest")
+	}
+	setTime("main.go", time.Now())
+	changed := hash()
+	if changed == first {
+		t.Error("hash did not change when a file's contents did")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != first {
+		t.Error("hash differs for the same contents")
+	}
+}
+
+func TestBuildContext(t *testing.T) {
+	dir := writeContext(t, map[string]string{
+		"Dockerfile":       "FROM alpine",
+		".dockerignore":    "*.log\n",
+		"main.go":          "package main",
+		"debug.log":        "",
+		"cmd/tool/main.go": "package tool",
+	})
+	buildCtx := buildContext(dir, "Dockerfile")
+	defer buildCtx.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(buildCtx)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+	want := map[string]string{
+		".dockerignore":    "*.log\n",
+		"Dockerfile":       "FROM alpine",
+		"main.go":          "package main",
+		"cmd/":             "",
+		"cmd/tool/":        "",
+		"cmd/tool/main.go": "package tool",
+	}
+	if !maps.Equal(files, want) {
+		t.Errorf("got %q, want %q", files, want)
+	}
+
+	// errors walking the context come out of the stream
+	if _, err := io.ReadAll(buildContext(dir, "Dockerfile.dev")); err == nil {
+		t.Error("expected an error for a missing dockerfile")
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name string
+		arch string
+		want string
+	}{
+		{name: "dev", arch: "amd64", want: "canon-dev:amd64-0123456789abcdef"},
+		{name: "My_Project.Dev", arch: "arm/v6", want: "canon-my-project-dev:arm-v6-0123456789abcdef"},
+		{name: "__", arch: "arm64", want: "canon-build:arm64-0123456789abcdef"},
+	}
+	for _, tc := range tests {
+		if got := buildTag(&Profile{name: tc.name, Arch: tc.arch}, hash); got != tc.want {
+			t.Errorf("buildTag(%q, %q) = %q, want %q", tc.name, tc.arch, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// cacheVolumeName returns the canon-managed volume name for a cache path, unique per profile and architecture.
+func cacheVolumeName(profile *Profile, cachePath string) string {
+	sanitize := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}
+	name := strings.Trim(strings.Map(sanitize, strings.TrimPrefix(cachePath, "~")), "_")
+	return fmt.Sprintf("canon-cache-%s-%s-%s", strings.Map(sanitize, profile.name), strings.Map(sanitize, profile.Arch), name)
+}
+
+// cacheTargets returns the in-container paths of the profile's caches, with ~ expanded.
+func cacheTargets(profile *Profile) []string {
+	var targets []string
+	for _, c := range profile.Caches {
+		// TODO check inside the container for the actual home directory
+		targets = append(targets, expandHome(c, "/home/"+profile.User))
+	}
+	return targets
+}
+
+// cacheMounts returns volume mounts for the profile's caches, creating the labeled volumes if needed.
+func cacheMounts(ctx context.Context, cli *client.Client, profile *Profile) ([]mount.Mount, error) {
+	var mounts []mount.Mount
+	targets := cacheTargets(profile)
+	for i, c := range profile.Caches {
+		name := cacheVolumeName(profile, c)
+		_, err := cli.VolumeCreate(ctx, volume.CreateOptions{
+			Name: name,
+			Labels: map[string]string{
+				"com.viam.canon.cache":      profile.name + "/" + profile.Arch,
+				"com.viam.canon.cache-path": c,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: name,
+			Target: targets[i],
+		})
+	}
+	return mounts, nil
+}
+
+func cacheCommand(ctx context.Context, profile *Profile, args []string) error {
+	if len(args) < 1 {
+		return errors.New("cache needs a subcommand: list or clear")
+	}
+	switch args[0] {
+	case "list":
+		return listCaches(ctx)
+	case "clear":
+		return clearCaches(ctx, profile, checkAll(args))
+	default:
+		return fmt.Errorf("unknown cache subcommand %s, use list or clear", args[0])
+	}
+}
+
+func listCaches(ctx context.Context) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	f := filters.NewArgs(filters.Arg("label", "com.viam.canon.cache"))
+	resp, err := cli.VolumeList(ctx, volume.ListOptions{Filters: f})
+	if err != nil {
+		return err
+	}
+	if len(resp.Volumes) == 0 {
+		fmt.Println("No canon caches found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "Profile/Arch\tPath\tVolume")
+	fmt.Fprintln(w, "------------\t----\t------")
+	for _, v := range resp.Volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Labels["com.viam.canon.cache"], v.Labels["com.viam.canon.cache-path"], v.Name)
+	}
+	return w.Flush()
+}
+
+func clearCaches(ctx context.Context, profile *Profile, all bool) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	f := filters.NewArgs()
+	if all {
+		f.Add("label", "com.viam.canon.cache")
+	} else {
+		f.Add("label", "com.viam.canon.cache="+profile.name+"/"+profile.Arch)
+	}
+	resp, err := cli.VolumeList(ctx, volume.ListOptions{Filters: f})
+	if err != nil {
+		return err
+	}
+	for _, v := range resp.Volumes {
+		fmt.Printf("removing cache %s (%s)\n", v.Labels["com.viam.canon.cache-path"], v.Labels["com.viam.canon.cache"])
+		if rmErr := cli.VolumeRemove(ctx, v.Name, false); rmErr != nil {
+			err = errors.Join(err, fmt.Errorf("%s may still be in use: %w", v.Name, rmErr))
+		}
+	}
+	return err
+}
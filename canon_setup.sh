@@ -5,6 +5,17 @@ CANON_UID=__CANON_UID__
 CANON_GID=__CANON_GID__
 CANON_USER=__CANON_USER__
 CANON_GROUP=__CANON_GROUP__
+CANON_CACHES=(__CANON_CACHES__)
+CANON_IDLE_TIMEOUT=__CANON_IDLE_TIMEOUT__
+
+# a restarted persistent container must not look ready until setup has run again
+rm -f /.canon-ready
+
+# setup failures are fatal, the container exits and canon reports the error
+fail() {
+  echo "# CANON_SETUP_FAILED: $*" >&2
+  exit 1
+}
 
 echo "# Running canon setup tasks inside new container..."
 if [[ -e /var/run/docker.sock ]] && getent group docker >/dev/null; then
@@ -46,26 +57,44 @@ fi
 echo "# Fixing ownership on files in /home/$CANON_USER"
 echo "# This may take a while depending on the number of files."
 (set -x; mkdir -p "/home/$CANON_USER")
+# caches are handled separately below, so skip them here
+PRUNE_CACHES=()
+for CACHE_DIR in "${CANON_CACHES[@]}"; do
+  PRUNE_CACHES+=(-path "$CACHE_DIR" -prune -o)
+done
 # find files with wrong ownership, chown in parallel batches across all cores
-(set -x; find "/home/$CANON_USER" \( ! -user $CANON_UID -o ! -group $CANON_GID \) -print0 | \
+(set -x; find "/home/$CANON_USER" "${PRUNE_CACHES[@]}" \( ! -user $CANON_UID -o ! -group $CANON_GID \) -print0 | \
   xargs -0 -r -P "$(nproc)" -n 100 chown -f $CANON_UID:$CANON_GID)
 
+# cache volumes are created root-owned, and may hold files from a previous UID, but walking a large cache on every
+# start is slow, so the owner last applied is recorded in the cache itself
+for CACHE_DIR in "${CANON_CACHES[@]}"; do
+  if [[ $(cat "$CACHE_DIR/.canon-owner" 2>/dev/null) == "$CANON_UID:$CANON_GID" ]]; then
+    continue
+  fi
+  echo "# Fixing ownership on cache $CACHE_DIR"
+  (set -x; mkdir -p "$CACHE_DIR")
+  (set -x; find "$CACHE_DIR" \( ! -user $CANON_UID -o ! -group $CANON_GID \) -print0 | \
+    xargs -0 -r -P "$(nproc)" -n 100 chown -f $CANON_UID:$CANON_GID)
+  echo "$CANON_UID:$CANON_GID" > "$CACHE_DIR/.canon-owner"
+done
+
 # group setup
 if getent group $CANON_GROUP >/dev/null; then
   echo "# Setting group GID to match profile"
-	(set -x; groupmod --gid $CANON_GID $CANON_GROUP)
+	(set -x; groupmod --gid $CANON_GID $CANON_GROUP) || fail "could not set GID of group $CANON_GROUP"
 else
   echo "# Creating group per profile"
-  (set -x; groupadd --gid $CANON_GID $CANON_GROUP)
+  (set -x; groupadd --gid $CANON_GID $CANON_GROUP) || fail "could not create group $CANON_GROUP"
 fi
 
 # user setup
 if getent passwd $CANON_USER >/dev/null; then
   echo "# Setting user UID to match profile"
-  (set -x; usermod --uid $CANON_UID $CANON_USER)
+  (set -x; usermod --uid $CANON_UID $CANON_USER) || fail "could not set UID of user $CANON_USER"
 else
   echo "# Creating user per profile"
-	(set -x; useradd --uid $CANON_UID --gid $CANON_GID $CANON_USER)
+	(set -x; useradd --uid $CANON_UID --gid $CANON_GID $CANON_USER) || fail "could not create user $CANON_USER"
 fi
 
 if which sudo >/dev/null; then
@@ -102,8 +131,30 @@ SHUTDOWN=0
 trap 'SHUTDOWN=1' SIGTERM
 
 # signals go that setup steps are complete and it's safe to call exec for the real commands
-echo "CANON_READY"
+touch /.canon-ready || fail "could not create ready marker"
+echo "# Setup complete"
 
+LAST_ACTIVE=$SECONDS
 until [[ $SHUTDOWN -gt 0 ]]; do
   sleep 1
+  if [[ $CANON_IDLE_TIMEOUT -gt 0 ]]; then
+    # each canon session writes the PID of its command to a file, so only live (non-zombie) commands count as
+    # activity, not daemons such as ssh-agent, or anything left running in the background
+    for PID_FILE in /tmp/.canon-exec-*.pid; do
+      [[ -s $PID_FILE ]] || continue
+      read -r PID < "$PID_FILE"
+      [[ $PID =~ ^[0-9]+$ && -r /proc/$PID/stat ]] || continue
+      STAT=$(< "/proc/$PID/stat")
+      STATE=${STAT##*) }
+      if [[ ${STATE%% *} != Z ]]; then
+        LAST_ACTIVE=$SECONDS
+        break
+      fi
+    done
+    if [[ $((SECONDS - LAST_ACTIVE)) -ge $CANON_IDLE_TIMEOUT ]]; then
+      echo "# Idle for ${CANON_IDLE_TIMEOUT}s, stopping container"
+      SHUTDOWN=1
+    fi
+  fi
 done
+rm -f /.canon-ready
@@ -10,9 +10,13 @@ import (
 	"flag"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,23 +25,56 @@ import (
 )
 
 type Profile struct {
-	name           string
-	Default        bool          `mapstructure:"default"         yaml:"default"`
-	Image          string        `mapstructure:"image"           yaml:"image"`
-	ImageAMD64     string        `mapstructure:"image_amd64"     yaml:"image_amd64"`
-	Image386       string        `mapstructure:"image_386"       yaml:"image_386"`
-	ImageARM64     string        `mapstructure:"image_arm64"     yaml:"image_arm64"`
-	ImageARM       string        `mapstructure:"image_arm"       yaml:"image_arm"`
-	ImageARMv6     string        `mapstructure:"image_arm_v6"    yaml:"image_arm_v6"`
-	Arch           string        `mapstructure:"arch"            yaml:"arch"`
-	MinimumDate    time.Time     `mapstructure:"minimum_date"    yaml:"minimum_date"`
-	UpdateInterval time.Duration `mapstructure:"update_interval" yaml:"update_interval"`
-	Persistent     bool          `mapstructure:"persistent"      yaml:"persistent"`
-	SSH            bool          `mapstructure:"ssh"             yaml:"ssh"`
-	NetRC          bool          `mapstructure:"netrc"           yaml:"netrc"`
-	User           string        `mapstructure:"user"            yaml:"user"`
-	Group          string        `mapstructure:"group"           yaml:"group"`
-	Path           string        `mapstructure:"path"            yaml:"path"`
+	name             string
+	chain            []string
+	reason           string            // why this profile was selected
+	instance         string            // which of multiple persistent containers to use, "" for the default
+	sources          map[string]string // where each field was last set, keyed by config name
+	cliEnv           map[string]string // from -e, only for the command being run, not the container's settings
+	cliPassEnv       []string          // from -e, like cliEnv
+	Default          bool              `mapstructure:"default"            yaml:"default"`
+	Image            string            `mapstructure:"image"              yaml:"image"`
+	ImageAMD64       string            `mapstructure:"image_amd64"        yaml:"image_amd64"`
+	Image386         string            `mapstructure:"image_386"          yaml:"image_386"`
+	ImageARM64       string            `mapstructure:"image_arm64"        yaml:"image_arm64"`
+	ImageARM         string            `mapstructure:"image_arm"          yaml:"image_arm"`
+	ImageARMv6       string            `mapstructure:"image_arm_v6"       yaml:"image_arm_v6"`
+	Arch             string            `mapstructure:"arch"               yaml:"arch"`
+	MinimumDate      time.Time         `mapstructure:"minimum_date"       yaml:"minimum_date"`
+	UpdateInterval   time.Duration     `mapstructure:"update_interval"    yaml:"update_interval"`
+	Persistent       bool              `mapstructure:"persistent"         yaml:"persistent"`
+	SSH              bool              `mapstructure:"ssh"                yaml:"ssh"`
+	NetRC            bool              `mapstructure:"netrc"              yaml:"netrc"`
+	User             string            `mapstructure:"user"               yaml:"user"`
+	Group            string            `mapstructure:"group"              yaml:"group"`
+	Path             string            `mapstructure:"path"               yaml:"path"`
+	Env              map[string]string `mapstructure:"env"                yaml:"env,omitempty"`
+	PassEnv          []string          `mapstructure:"pass_env"           yaml:"pass_env,omitempty"`
+	Mounts           []MountDef        `mapstructure:"mounts"             yaml:"mounts,omitempty"`
+	Caches           []string          `mapstructure:"caches"             yaml:"caches,omitempty"`
+	Extends          []string          `mapstructure:"extends"            yaml:"extends,omitempty"`
+	RecreateOnChange string            `mapstructure:"recreate_on_change" yaml:"recreate_on_change,omitempty"`
+	AutoUpgrade      bool              `mapstructure:"auto_upgrade"       yaml:"auto_upgrade,omitempty"`
+	IdleTimeout      time.Duration     `mapstructure:"idle_timeout"       yaml:"idle_timeout,omitempty"`
+	SetupTimeout     time.Duration     `mapstructure:"setup_timeout"      yaml:"setup_timeout,omitempty"`
+	Build            BuildDef          `mapstructure:"build"              yaml:"build,omitempty"`
+}
+
+// MountDef is an extra bind mount or named volume to attach to the container.
+type MountDef struct {
+	Type     string `mapstructure:"type"      yaml:"type,omitempty"`
+	Source   string `mapstructure:"source"    yaml:"source"`
+	Target   string `mapstructure:"target"    yaml:"target"`
+	ReadOnly bool   `mapstructure:"read_only" yaml:"read_only,omitempty"`
+}
+
+// BuildDef builds the profile's image from a local Dockerfile, rather than pulling it.
+type BuildDef struct {
+	Context    string            `mapstructure:"context"    yaml:"context,omitempty"`
+	Dockerfile string            `mapstructure:"dockerfile" yaml:"dockerfile,omitempty"`
+	Args       map[string]string `mapstructure:"args"       yaml:"args,omitempty"`
+	Target     string            `mapstructure:"target"     yaml:"target,omitempty"`
+	Platforms  []string          `mapstructure:"platforms"  yaml:"platforms,omitempty"`
 }
 
 var activeProfile = &Profile{}
@@ -49,6 +86,7 @@ func newProfile(loadUserDefaults bool) (*Profile, error) {
 		Arch:           runtime.GOARCH,
 		MinimumDate:    time.Time{},
 		UpdateInterval: time.Hour * 24,
+		SetupTimeout:   time.Minute * 10,
 		Persistent:     false,
 		SSH:            true,
 		NetRC:          true,
@@ -56,11 +94,14 @@ func newProfile(loadUserDefaults bool) (*Profile, error) {
 		Group:          "canon",
 		Path:           "/",
 	}
+	for _, field := range profileFields() {
+		prof.setSource(field, "builtin")
+	}
 
 	if loadUserDefaults {
 		def, ok := mergedCfg["defaults"]
 		if ok {
-			return prof, mergeProfile(def, prof)
+			return prof, mergeProfile("defaults", def, prof)
 		}
 	}
 	return prof, nil
@@ -69,16 +110,39 @@ func newProfile(loadUserDefaults bool) (*Profile, error) {
 // Global so it can be referenced in update.
 var mergedCfg map[string]interface{}
 
+// All config files that were read, in merge order, for validation.
+var loadedCfgFiles []string
+
+// The file and line that last set each key of each profile in mergedCfg, for "config --explain".
+var cfgSources = make(map[string]map[string]string)
+
+// The config files that define (or override) each profile, in merge order.
+var cfgProfileFiles = make(map[string][]string)
+
+// Project config files (outermost first), the profiles defined in them (or their includes), and the merged config of
+// just those files, without the user's config.
+var (
+	projectCfgFiles []string
+	projectProfiles = make(map[string]bool)
+	projectCfg      = make(map[string]interface{})
+)
+
 func parseConfigs() error {
-	// load a local/project specific config if found
+	// load local/project specific configs if found, outermost first so nested projects can override
 	cfg := make(map[string]interface{})
-	projCfgFile, err := findProjectConfig()
-	if err == nil {
+	projCfgFiles, err := findProjectConfigs()
+	if err != nil {
+		return err
+	}
+	projectCfgFiles = projCfgFiles
+	for _, projCfgFile := range projCfgFiles {
 		cfg, err = mergeInConfig(cfg, projCfgFile, true)
 		if err != nil {
 			return err
 		}
 	}
+	// merging the user config modifies profile maps in place, so keep a copy
+	projectCfg = copyCfg(cfg)
 	// override with settings from user's default or cli specified config
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -98,13 +162,17 @@ func parseConfigs() error {
 	}
 	mergedCfg = cfg
 
+	if err := readImageLocks(projCfgFiles); err != nil {
+		return err
+	}
+
 	activeProfile, err = newProfile(true)
 	if err != nil {
 		return err
 	}
 
 	// determine the default profile from configs
-	defProfileName, err := getDefaultProfile(cfg)
+	defProfileName, reason, err := getDefaultProfile(cfg)
 	if err != nil {
 		return err
 	}
@@ -113,7 +181,9 @@ func parseConfigs() error {
 	// override with cli specified profile
 	if profArg := getEarlyFlag("profile"); profArg != "" {
 		profileName = profArg
+		reason = "given with -profile on the command line"
 	}
+	activeProfile.reason = reason
 
 	if profileName != "" {
 		// find and load profile
@@ -121,7 +191,7 @@ func parseConfigs() error {
 		if !ok {
 			return fmt.Errorf("no profile named %s", profileName)
 		}
-		if err := mergeProfile(p, activeProfile); err != nil {
+		if err := mergeProfile(profileName, p, activeProfile); err != nil {
 			return err
 		}
 		activeProfile.name = profileName
@@ -134,70 +204,186 @@ func parseConfigs() error {
 		fmt.Fprintf(os.Stderr, "Usage:\n\n")
 		fmt.Fprintf(os.Stderr, "  Interactive shell\n  %s [shell]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Directly run a command\n  %s command arg1 ... argN\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  Show current config\n  %s config\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  Update docker images\n  %s update [-a(ll)]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Run a command in a running canon container\n  %s exec <id|name|profile> [-- cmd ...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Show current config, optionally with where each value came from\n  %s config [--explain]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Check all loaded config files for problems\n  %s config validate\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Print a JSON Schema for config files\n  %s config schema\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  List all known profiles\n  %s profiles [--json]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Update docker images, rebuilding built ones even if unchanged\n  %s update [-a(ll)] [--rebuild]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Pin the project's images to their current digests in .canon.lock\n  %s lock [--update]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Recreate the persistent container on the latest image\n  %s upgrade\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  List active canon-managed container(s)\n  %s list\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Terminate (stop/close) canon-managed container(s)\n  %s terminate [-a(ll)]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Remove one-shot containers left behind by killed canon processes\n  %s gc\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  List or clear canon-managed build caches\n  %s cache list|clear [-a(ll)]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options (defaults shown from current profile):\n")
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&cfgPath, "config", userCfgPath, "config file")
+	flag.StringVar(&outputFormat, "output", outputFormat, "output format of list, config, profiles, update (\"table\", \"json\", \"yaml\")")
 	flag.StringVar(&profileName, "profile", defProfileName, "profile name")
 	flag.StringVar(&activeProfile.Image, "image", activeProfile.Image, "docker image name")
 	flag.StringVar(&activeProfile.Arch, "arch", activeProfile.Arch, "architecture (\"amd64\", \"arm64\", \"386\", \"arm\", \"arm/v6\")")
 	flag.StringVar(&activeProfile.User, "user", activeProfile.User, "user to map to inside the canon environment")
 	flag.StringVar(&activeProfile.Group, "group", activeProfile.Group, "group to map to inside the canon environment")
 	flag.BoolVar(&activeProfile.SSH, "ssh", activeProfile.SSH, "mount ~/.ssh (read-only) and forward SSH_AUTH_SOCK to the canon environment")
+	flag.StringVar(&activeProfile.instance, "instance", "", "named instance, to run several persistent containers for one profile")
 	flag.BoolVar(&activeProfile.NetRC, "netrc", activeProfile.NetRC, "mount ~/.netrc (read-only) in the canon environment")
+	flag.Var(envFlag{activeProfile}, "e", "set an environment variable (KEY=VALUE) or pass one through from the host (KEY), may be repeated")
 
 	flag.Parse()
 
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "image", "arch", "user", "group", "ssh", "netrc":
+			activeProfile.setSource(f.Name, "command line (-"+f.Name+")")
+		}
+	})
+
 	// swap again in case a CLI arg would change arch
 	swapArchImage(activeProfile)
+	if err := validateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	if err := validateInstance(activeProfile.instance); err != nil {
+		return err
+	}
+	if err := validateRecreateOnChange(activeProfile.RecreateOnChange); err != nil {
+		return err
+	}
+	if activeProfile.IdleTimeout < 0 {
+		return errors.New("idle_timeout cannot be negative")
+	}
+	if activeProfile.SetupTimeout < 0 {
+		return errors.New("setup_timeout cannot be negative")
+	}
+	if err := validateMounts(activeProfile.Mounts); err != nil {
+		return err
+	}
+	if err := validateCaches(activeProfile.Caches); err != nil {
+		return err
+	}
+	if err := validateBuild(activeProfile.Build); err != nil {
+		return err
+	}
 	return validateArch(activeProfile.Arch)
 }
 
-func findProjectConfig() (string, error) {
+// findProjectConfigs returns all project configs from the current directory upward, ordered from the outermost to
+// the innermost. The search stops at the first config with "root: true".
+func findProjectConfigs() ([]string, error) {
 	var cwd string
 	cwd, err := os.Getwd()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	var paths []string
 	for {
 		path := filepath.Join(cwd, ".canon.yaml")
 		_, err = os.Stat(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// such as a parent directory the user can't read, which is as far up as projects can be found
+			break
+		}
 		if err == nil {
-			return path, nil
+			paths = append([]string{path}, paths...)
+			isRoot, err := isRootConfig(path)
+			if err != nil {
+				return nil, err
+			}
+			if isRoot {
+				break
+			}
 		}
-		if !errors.Is(err, fs.ErrNotExist) || cwd == string(os.PathSeparator) {
-			return "", err
+		if cwd == string(os.PathSeparator) {
+			break
 		}
 		cwd = filepath.Dir(cwd)
 	}
+	return paths, nil
+}
+
+func isRootConfig(path string) (bool, error) {
+	cfgData, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	cfg := make(map[string]interface{})
+	if err := yaml.Unmarshal(cfgData, cfg); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	isRoot, _ := cfg["root"].(bool)
+	return isRoot, nil
 }
 
 func mergeInConfig(cfg map[string]interface{}, path string, setPath bool) (map[string]interface{}, error) {
+	var rootDir string
+	if setPath {
+		rootDir = filepath.Dir(path)
+	}
+	return mergeInConfigFile(cfg, path, rootDir, nil)
+}
+
+// mergeInConfigFile merges a config file (after any files it includes) into cfg. If rootDir is set, it's used as the
+// path for any profiles that don't specify one, including those in included files.
+func mergeInConfigFile(cfg map[string]interface{}, path, rootDir string, stack []string) (map[string]interface{}, error) {
 	cfgNew := make(map[string]interface{})
 	cfgData, err := os.ReadFile(path)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, fs.ErrNotExist) && len(stack) == 0 {
 			return cfg, nil
 		}
 		return nil, err
 	}
+	loadedCfgFiles = append(loadedCfgFiles, path)
 	err = yaml.Unmarshal(cfgData, cfgNew)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(cfgData, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// only used when searching for project configs
+	delete(cfgNew, "root")
+
+	// included files are merged first, so the including file can override them
+	if inc, ok := cfgNew["include"]; ok {
+		delete(cfgNew, "include")
+		includes, err := findIncludes(path, inc)
+		if err != nil {
+			return nil, err
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, incPath := range includes {
+			if slices.Contains(stack, incPath) || incPath == absPath {
+				return nil, fmt.Errorf("config include cycle: %s includes %s", path, incPath)
+			}
+			cfg, err = mergeInConfigFile(cfg, incPath, rootDir, append(slices.Clone(stack), absPath))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
+	recordSources(path, &doc)
+
 	for k, v := range cfgNew {
 		prof, ok := v.(map[string]interface{})
 		if ok {
+			if rootDir != "" && k != "defaults" {
+				projectProfiles[k] = true
+			}
 			_, ok = prof["path"]
-			if !ok && setPath {
-				prof["path"] = filepath.Dir(path)
+			if !ok && rootDir != "" {
+				prof["path"] = rootDir
+				setCfgSource(k, "path", "set automatically from "+path)
 			}
 
 			prev, ok := cfg[k]
@@ -226,6 +412,86 @@ func mergeInConfig(cfg map[string]interface{}, path string, setPath bool) (map[s
 	return outCfg, nil
 }
 
+// recordSources notes the location of each profile key set in a config file.
+func recordSources(path string, doc *yaml.Node) {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return
+	}
+	top := doc.Content[0]
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		prof := top.Content[i+1]
+		if prof.Kind != yaml.MappingNode {
+			continue
+		}
+		cfgProfileFiles[top.Content[i].Value] = append(cfgProfileFiles[top.Content[i].Value], path)
+		for j := 0; j+1 < len(prof.Content); j += 2 {
+			key := prof.Content[j]
+			setCfgSource(top.Content[i].Value, key.Value, fmt.Sprintf("%s:%d", path, key.Line))
+		}
+	}
+}
+
+func setCfgSource(profile, key, src string) {
+	if cfgSources[profile] == nil {
+		cfgSources[profile] = make(map[string]string)
+	}
+	cfgSources[profile][key] = src
+}
+
+func (p *Profile) setSource(field, src string) {
+	if p.sources == nil {
+		p.sources = make(map[string]string)
+	}
+	p.sources[field] = src
+}
+
+// findIncludes expands the include entries of a config file (a path/glob or a list of them) to absolute file paths.
+// Relative entries are relative to the including file's directory.
+func findIncludes(path string, inc interface{}) ([]string, error) {
+	var patterns []string
+	switch val := inc.(type) {
+	case string:
+		patterns = []string{val}
+	case []interface{}:
+		for _, v := range val {
+			pattern, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include entries must be strings, got %v", path, v)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a path or list of paths", path)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var includes []string
+	for _, pattern := range patterns {
+		pattern = expandHome(pattern, home)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		pattern, err = filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include pattern %s: %w", path, pattern, err)
+		}
+		// a glob may match nothing, but a plain path must exist
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s not found", path, pattern)
+		}
+		includes = append(includes, matches...)
+	}
+	return includes, nil
+}
+
 func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
 	out := make(map[string]interface{}, len(a))
 	for k, v := range a {
@@ -245,34 +511,113 @@ func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
 	return out
 }
 
-func mergeProfile(in interface{}, out *Profile) error {
+// copyCfg deep copies a decoded config.
+func copyCfg(cfg map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(cfg))
+	for k, v := range cfg {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			out[k] = copyCfg(val)
+		case []interface{}:
+			out[k] = slices.Clone(val)
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// mergeProfile decodes the named profile over out, after first merging any profiles it extends.
+func mergeProfile(name string, in interface{}, out *Profile) error {
+	return mergeProfileChain([]string{name}, in, out)
+}
+
+func mergeProfileChain(stack []string, in interface{}, out *Profile) error {
+	name := stack[len(stack)-1]
+	if slices.Contains(out.chain, name) {
+		// already applied via another branch of the inheritance tree
+		return nil
+	}
+
 	// decode twice, as it's easier to check against a temp struct
 	tempProf := &Profile{}
 	if err := mapDecode(in, tempProf); err != nil {
-		return err
+		return fmt.Errorf("profile %s: %w", name, err)
 	}
+
+	for _, parent := range tempProf.Extends {
+		if slices.Contains(stack, parent) {
+			return fmt.Errorf("profile inheritance cycle: %s -> %s", strings.Join(stack, " -> "), parent)
+		}
+		p, ok := mergedCfg[parent]
+		if !ok {
+			return fmt.Errorf("profile %s extends unknown profile %s", name, parent)
+		}
+		if _, ok := p.(map[string]interface{}); !ok {
+			return fmt.Errorf("profile %s extends %s, which is not a profile", name, parent)
+		}
+		if err := mergeProfileChain(append(slices.Clone(stack), parent), p, out); err != nil {
+			return err
+		}
+	}
+	out.chain = append(out.chain, name)
+	if inMap, ok := in.(map[string]interface{}); ok {
+		for key := range inMap {
+			src, ok := cfgSources[name][key]
+			if !ok {
+				src = "unknown file"
+			}
+			out.setSource(key, fmt.Sprintf("%s (%s)", src, name))
+		}
+	}
+	// as with config layers, a plain image and arch-specific images from lower layers don't mix
 	for _, img := range []string{tempProf.ImageAMD64, tempProf.ImageARM64, tempProf.ImageARM, tempProf.ImageARMv6, tempProf.Image386} {
 		if img != "" {
 			out.Image = ""
+			out.setSource("image", "cleared by arch-specific images in "+name)
 			break
 		}
 	}
+	if tempProf.Image != "" {
+		out.ImageAMD64, out.ImageARM64, out.ImageARM, out.ImageARMv6, out.Image386 = "", "", "", "", ""
+		for _, field := range []string{"image_amd64", "image_arm64", "image_arm", "image_arm_v6", "image_386"} {
+			out.setSource(field, "cleared by image in "+name)
+		}
+	}
+	// lists replace, rather than extend, those from lower layers
+	if tempProf.PassEnv != nil {
+		out.PassEnv = nil
+	}
+	if tempProf.Mounts != nil {
+		out.Mounts = nil
+	}
+	if tempProf.Caches != nil {
+		out.Caches = nil
+	}
+	if tempProf.Extends != nil {
+		out.Extends = nil
+	}
+	if tempProf.Build.Platforms != nil {
+		out.Build.Platforms = nil
+	}
 	return mapDecode(in, out)
 }
 
-func getDefaultProfile(cfg map[string]interface{}) (string, error) {
+// getDefaultProfile returns the profile to use when none is given on the command line, along with the reason it was chosen.
+func getDefaultProfile(cfg map[string]interface{}) (string, string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	cwd, err = filepath.Abs(cwd)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	candidates := map[string]bool{}
 
+	// walk upward from the current directory, so the deepest (most specific) matching path wins
 	for {
 		for pName, p := range cfg {
 			prof, ok := p.(map[string]interface{})
@@ -290,7 +635,7 @@ func getDefaultProfile(cfg map[string]interface{}) (string, error) {
 
 			hostpath, err := filepath.Abs(pathStr)
 			if err != nil {
-				return "", err
+				return "", "", err
 			}
 			if hostpath == cwd {
 				candidates[pName] = false
@@ -315,7 +660,7 @@ func getDefaultProfile(cfg map[string]interface{}) (string, error) {
 
 	if len(candidates) == 1 {
 		for p := range candidates {
-			return p, nil
+			return p, fmt.Sprintf("only profile with a path (%s) containing the current directory", cwd), nil
 		}
 	}
 
@@ -336,13 +681,18 @@ func getDefaultProfile(cfg map[string]interface{}) (string, error) {
 				keys = append(keys, k)
 			}
 			if numDefaults == 0 {
-				return "", fmt.Errorf("multiple profiles %s match the current path, and none have the 'default' value set", keys)
+				return "", "", fmt.Errorf("multiple profiles %s match the current path, and none have the 'default' value set", keys)
 			}
 			if numDefaults > 1 {
-				return "", fmt.Errorf("multiple profiles %s match the current path and have the 'default' value set", keys)
+				return "", "", fmt.Errorf("multiple profiles %s match the current path and have the 'default' value set", keys)
 			}
 		}
-		return firstDef, nil
+		keys := []string{}
+		for k := range candidates {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return firstDef, fmt.Sprintf("has 'default: true' among profiles %s with a path (%s) containing the current directory", keys, cwd), nil
 	}
 
 	d, ok := cfg["defaults"]
@@ -353,13 +703,85 @@ func getDefaultProfile(cfg map[string]interface{}) (string, error) {
 			if ok {
 				pName, ok := p.(string)
 				if ok {
-					return pName, nil
+					return pName, "no profile path contains the current directory, so using 'profile' from the defaults section", nil
 				}
 			}
 		}
 	}
 
-	return "", nil
+	return "", "no profile path contains the current directory and no default profile is set, so using builtin values and defaults", nil
+}
+
+// envFlag handles the repeatable -e option, in the same KEY=VALUE or KEY form as "docker run -e".
+type envFlag struct {
+	profile *Profile
+}
+
+func (e envFlag) String() string {
+	return ""
+}
+
+func (e envFlag) Set(val string) error {
+	key, value, ok := strings.Cut(val, "=")
+	if key == "" {
+		return errors.New("environment variable name cannot be empty")
+	}
+	if !ok {
+		e.profile.cliPassEnv = append(e.profile.cliPassEnv, key)
+		return nil
+	}
+	if e.profile.cliEnv == nil {
+		e.profile.cliEnv = make(map[string]string)
+	}
+	e.profile.cliEnv[key] = value
+	return nil
+}
+
+// environment returns the KEY=VALUE list for the container, with host variables matched by pass_env
+// (names or globs) overridden by any static env values.
+func (p *Profile) environment() ([]string, error) {
+	return envList(p.PassEnv, p.Env)
+}
+
+// execEnvironment returns the KEY=VALUE list for a command run in the container, which is the container's environment
+// extended by any -e options. These are kept out of the profile's settings, so a one-off -e doesn't count as a change
+// to a persistent container.
+func (p *Profile) execEnvironment() ([]string, error) {
+	env := maps.Clone(p.Env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	maps.Copy(env, p.cliEnv)
+	return envList(append(slices.Clone(p.PassEnv), p.cliPassEnv...), env)
+}
+
+func envList(passEnv []string, static map[string]string) ([]string, error) {
+	vars := make(map[string]string)
+	for _, pattern := range passEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pass_env pattern %q: %w", pattern, err)
+		}
+		for _, hostVar := range os.Environ() {
+			key, value, _ := strings.Cut(hostVar, "=")
+			ok, err := filepath.Match(pattern, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pass_env pattern %q: %w", pattern, err)
+			}
+			if ok {
+				vars[key] = value
+			}
+		}
+	}
+	for key, value := range static {
+		vars[key] = value
+	}
+
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
 }
 
 func getEarlyFlag(flagName string) string {
@@ -376,13 +798,17 @@ func getEarlyFlag(flagName string) string {
 }
 
 func checkAll(args []string) bool {
-	all := false
-	if len(args) >= 2 {
-		if args[1] == "-a" || args[1] == "-all" || args[1] == "--all" {
-			all = true
+	return len(args) >= 2 && (hasArg(args[1:], "a") || hasArg(args[1:], "all"))
+}
+
+// hasArg checks for a boolean option given after the command, such as "config --explain".
+func hasArg(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "-"+name || arg == "--"+name {
+			return true
 		}
 	}
-	return all
+	return false
 }
 
 func swapArchImage(profile *Profile) {
@@ -398,36 +824,123 @@ func swapArchImage(profile *Profile) {
 		return
 	}
 
+	var field string
 	switch profile.Arch {
 	case "amd64":
 		profile.Image = profile.ImageAMD64
+		field = "image_amd64"
 	case "arm64":
 		profile.Image = profile.ImageARM64
+		field = "image_arm64"
 	case "arm":
 		profile.Image = profile.ImageARM
+		field = "image_arm"
 	case "arm/v6":
 		profile.Image = profile.ImageARMv6
+		field = "image_arm_v6"
 	case "386":
 		profile.Image = profile.Image386
+		field = "image_386"
 	default:
 		profile.Image = ""
+		profile.setSource("image", "cleared for unknown arch "+profile.Arch)
+		return
 	}
+	profile.setSource("image", fmt.Sprintf("%s for arch %s, from %s", field, profile.Arch, profile.sources[field]))
 }
 
-func showConfig(profile *Profile) {
+type configInfo struct {
+	Merged  map[string]interface{} `json:"merged"  yaml:"merged"`
+	Name    string                 `json:"name"    yaml:"name"`
+	Reason  string                 `json:"reason"  yaml:"reason"`
+	Chain   []string               `json:"chain"   yaml:"chain"`
+	Profile map[string]interface{} `json:"profile" yaml:"profile"`
+	Sources map[string]string      `json:"sources" yaml:"sources"`
+}
+
+func showConfig(profile *Profile, explain bool) error {
+	if structuredOutput() {
+		// round trip through yaml so the profile uses its config field names
+		profYaml, err := yaml.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		profMap := make(map[string]interface{})
+		if err := yaml.Unmarshal(profYaml, profMap); err != nil {
+			return err
+		}
+		return printStructured(configInfo{
+			Merged:  mergedCfg,
+			Name:    profile.name,
+			Reason:  profile.reason,
+			Chain:   append([]string{"builtin"}, profile.chain...),
+			Profile: profMap,
+			Sources: profile.sources,
+		})
+	}
+
 	ret, err := yaml.Marshal(mergedCfg)
-	printIfErr(err)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("# All explicitly parsed/merged config files (without builtin/default/cli)\n---\n%s\n\n", ret)
 
-	ret, err = yaml.Marshal(map[string]Profile{profile.name: *profile})
-	printIfErr(err)
-	fmt.Printf("# Active, merged profile (including builtin/user defaults and cli arguments)\n---\n%s\n", ret)
+	var node yaml.Node
+	if err := node.Encode(map[string]Profile{profile.name: *profile}); err != nil {
+		return err
+	}
+	if explain {
+		annotateSources(&node, profile)
+	}
+	ret, err = yaml.Marshal(&node)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Active, merged profile (including builtin/user defaults and cli arguments)\n")
+	if len(profile.chain) > 0 {
+		fmt.Printf("# Merged in order: builtin -> %s\n", strings.Join(profile.chain, " -> "))
+	}
+	if explain {
+		fmt.Printf("# Profile %q selected because: %s\n", profile.name, profile.reason)
+	}
+	fmt.Printf("---\n%s\n", ret)
+	return nil
+}
+
+// annotateSources adds a comment to each field of an encoded profile noting where its value came from.
+func annotateSources(node *yaml.Node, profile *Profile) {
+	if node.Kind != yaml.MappingNode || len(node.Content) < 2 {
+		return
+	}
+	fields := node.Content[1]
+	for i := 0; i+1 < len(fields.Content); i += 2 {
+		key, val := fields.Content[i], fields.Content[i+1]
+		src, ok := profile.sources[key.Value]
+		if !ok {
+			continue
+		}
+		if val.Kind == yaml.ScalarNode {
+			val.LineComment = src
+		} else {
+			key.LineComment = src
+		}
+	}
 }
 
 func mapDecode(iface interface{}, p *Profile) error {
+	return decodeProfile(iface, p, false)
+}
+
+// mapDecodeStrict is like mapDecode, but errors on any keys that don't match a profile field.
+func mapDecodeStrict(iface interface{}, p *Profile) error {
+	return decodeProfile(iface, p, true)
+}
+
+func decodeProfile(iface interface{}, p *Profile, strict bool) error {
 	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
-		Result:     p,
+		DecodeHook:  mapstructure.ComposeDecodeHookFunc(mapstructure.StringToTimeDurationHookFunc(), stringToSliceHookFunc()),
+		ErrorUnused: strict,
+		Result:      p,
 	})
 	if err != nil {
 		return err
@@ -435,6 +948,16 @@ func mapDecode(iface interface{}, p *Profile) error {
 	return dec.Decode(iface)
 }
 
+// stringToSliceHookFunc allows single values to be given for list fields, such as "extends: base".
+func stringToSliceHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() == reflect.String && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String {
+			return []string{data.(string)}, nil
+		}
+		return data, nil
+	}
+}
+
 func validateArch(arch string) error {
 	switch arch {
 	case "amd64":
@@ -483,3 +1006,75 @@ func validateArch(arch string) error {
 		return errors.New("Invalid architecture: " + arch)
 	}
 }
+
+func validateMounts(mounts []MountDef) error {
+	for _, m := range mounts {
+		switch m.Type {
+		case "", "bind", "volume":
+		default:
+			return fmt.Errorf("invalid mount type %q for target %s; use \"bind\" or \"volume\"", m.Type, m.Target)
+		}
+		if m.Source == "" {
+			return fmt.Errorf("mount for target %s has no source", m.Target)
+		}
+		if m.Target == "" {
+			return fmt.Errorf("mount for source %s has no target", m.Source)
+		}
+		if !isContainerPath(m.Target) {
+			return fmt.Errorf("mount target %s must be an absolute path or start with ~/", m.Target)
+		}
+		if m.Type == "volume" && strings.ContainsRune(m.Source, os.PathSeparator) {
+			return fmt.Errorf("volume name %s cannot contain a path separator, use type \"bind\" for host paths", m.Source)
+		}
+	}
+	return nil
+}
+
+func validateRecreateOnChange(mode string) error {
+	switch mode {
+	case "", "ask", "always", "never":
+		return nil
+	default:
+		return fmt.Errorf("invalid recreate_on_change value %q; use \"ask\", \"always\", or \"never\"", mode)
+	}
+}
+
+func validateInstance(instance string) error {
+	for _, r := range instance {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' && r != '.' && r != '-' {
+			return fmt.Errorf("invalid instance name %q, use only letters, numbers, '_', '.', and '-'", instance)
+		}
+	}
+	return nil
+}
+
+func validateCaches(caches []string) error {
+	for _, c := range caches {
+		if !isContainerPath(c) {
+			return fmt.Errorf("cache path %s must be an absolute path or start with ~/", c)
+		}
+	}
+	return nil
+}
+
+func validateBuild(build BuildDef) error {
+	if build.Context == "" {
+		if build.Dockerfile != "" || build.Target != "" || len(build.Args) > 0 || len(build.Platforms) > 0 {
+			return errors.New("build settings need a build context directory")
+		}
+		return nil
+	}
+	if build.Dockerfile != "" && (filepath.IsAbs(build.Dockerfile) || !filepath.IsLocal(build.Dockerfile)) {
+		return fmt.Errorf("build dockerfile %s must be a path inside the build context", build.Dockerfile)
+	}
+	for _, arch := range build.Platforms {
+		if err := validateArch(arch); err != nil {
+			return fmt.Errorf("build platforms: %w", err)
+		}
+	}
+	return nil
+}
+
+func isContainerPath(path string) bool {
+	return filepath.IsAbs(path) || path == "~" || strings.HasPrefix(path, "~/")
+}
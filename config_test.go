@@ -0,0 +1,288 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setMergedCfg replaces the merged config for the duration of a test.
+func setMergedCfg(t *testing.T, cfg map[string]interface{}) {
+	t.Helper()
+	old := mergedCfg
+	mergedCfg = cfg
+	t.Cleanup(func() { mergedCfg = old })
+}
+
+func TestMergeProfileChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]interface{}
+		profile string
+		wantErr string
+		check   func(t *testing.T, p *Profile)
+	}{
+		{
+			name: "single parent",
+			cfg: map[string]interface{}{
+				"base":  map[string]interface{}{"image": "alpine", "user": "builder"},
+				"child": map[string]interface{}{"extends": []interface{}{"base"}, "user": "tester"},
+			},
+			profile: "child",
+			check: func(t *testing.T, p *Profile) {
+				t.Helper()
+				if p.Image != "alpine" || p.User != "tester" {
+					t.Errorf("got image %q user %q, want alpine and tester", p.Image, p.User)
+				}
+			},
+		},
+		{
+			name: "diamond applies the shared parent once",
+			cfg: map[string]interface{}{
+				"base":  map[string]interface{}{"image": "alpine", "pass_env": []interface{}{"BASE"}},
+				"left":  map[string]interface{}{"extends": []interface{}{"base"}, "pass_env": []interface{}{"LEFT"}},
+				"right": map[string]interface{}{"extends": []interface{}{"base"}, "user": "right"},
+				"child": map[string]interface{}{"extends": []interface{}{"left", "right"}},
+			},
+			profile: "child",
+			check: func(t *testing.T, p *Profile) {
+				t.Helper()
+				if want := []string{"base", "left", "right", "child"}; !slices.Equal(p.chain, want) {
+					t.Errorf("got chain %v, want %v", p.chain, want)
+				}
+				// base must not be reapplied via right, which would bring back its pass_env
+				if want := []string{"LEFT"}; !slices.Equal(p.PassEnv, want) {
+					t.Errorf("got pass_env %v, want %v", p.PassEnv, want)
+				}
+			},
+		},
+		{
+			name: "cycle",
+			cfg: map[string]interface{}{
+				"a": map[string]interface{}{"extends": []interface{}{"b"}},
+				"b": map[string]interface{}{"extends": []interface{}{"c"}},
+				"c": map[string]interface{}{"extends": []interface{}{"a"}},
+			},
+			profile: "a",
+			wantErr: "profile inheritance cycle: a -> b -> c -> a",
+		},
+		{
+			name: "self reference",
+			cfg: map[string]interface{}{
+				"a": map[string]interface{}{"extends": []interface{}{"a"}},
+			},
+			profile: "a",
+			wantErr: "profile inheritance cycle: a -> a",
+		},
+		{
+			name: "unknown parent",
+			cfg: map[string]interface{}{
+				"a": map[string]interface{}{"extends": []interface{}{"missing"}},
+			},
+			profile: "a",
+			wantErr: "profile a extends unknown profile missing",
+		},
+		{
+			name: "parent is not a profile",
+			cfg: map[string]interface{}{
+				"a":    map[string]interface{}{"extends": []interface{}{"root"}},
+				"root": true,
+			},
+			profile: "a",
+			wantErr: "profile a extends root, which is not a profile",
+		},
+		{
+			name: "image clears inherited arch images",
+			cfg: map[string]interface{}{
+				"base":  map[string]interface{}{"image_amd64": "amd", "image_arm64": "arm"},
+				"child": map[string]interface{}{"extends": []interface{}{"base"}, "image": "alpine"},
+			},
+			profile: "child",
+			check: func(t *testing.T, p *Profile) {
+				t.Helper()
+				if p.Image != "alpine" || p.ImageAMD64 != "" || p.ImageARM64 != "" {
+					t.Errorf("got image %q amd64 %q arm64 %q, want only alpine", p.Image, p.ImageAMD64, p.ImageARM64)
+				}
+			},
+		},
+		{
+			name: "arch image clears inherited image",
+			cfg: map[string]interface{}{
+				"base":  map[string]interface{}{"image": "alpine"},
+				"child": map[string]interface{}{"extends": []interface{}{"base"}, "image_arm64": "arm"},
+			},
+			profile: "child",
+			check: func(t *testing.T, p *Profile) {
+				t.Helper()
+				if p.Image != "" || p.ImageARM64 != "arm" {
+					t.Errorf("got image %q arm64 %q, want only arm64", p.Image, p.ImageARM64)
+				}
+			},
+		},
+		{
+			name: "lists replace inherited lists",
+			cfg: map[string]interface{}{
+				"base":  map[string]interface{}{"caches": []interface{}{"/a", "/b"}},
+				"child": map[string]interface{}{"extends": []interface{}{"base"}, "caches": []interface{}{"/c"}},
+			},
+			profile: "child",
+			check: func(t *testing.T, p *Profile) {
+				t.Helper()
+				if want := []string{"/c"}; !slices.Equal(p.Caches, want) {
+					t.Errorf("got caches %v, want %v", p.Caches, want)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setMergedCfg(t, tc.cfg)
+			p := &Profile{}
+			err := mergeProfile(tc.profile, tc.cfg[tc.profile], p)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, p)
+		})
+	}
+}
+
+func TestFindIncludes(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.yaml", "b.yaml", "sub/c.yaml"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgPath := filepath.Join(dir, ".canon.yaml")
+
+	tests := []struct {
+		name    string
+		inc     interface{}
+		want    []string
+		wantErr string
+	}{
+		{name: "relative path", inc: "a.yaml", want: []string{"a.yaml"}},
+		{name: "absolute path", inc: filepath.Join(dir, "sub/c.yaml"), want: []string{"sub/c.yaml"}},
+		{name: "glob", inc: "*.yaml", want: []string{"a.yaml", "b.yaml"}},
+		{name: "list", inc: []interface{}{"b.yaml", "sub/*.yaml"}, want: []string{"b.yaml", "sub/c.yaml"}},
+		{name: "glob matching nothing", inc: "none/*.yaml"},
+		{name: "missing path", inc: "missing.yaml", wantErr: "not found"},
+		{name: "bad pattern", inc: "[.yaml", wantErr: "invalid include pattern"},
+		{name: "non-string entry", inc: []interface{}{"a.yaml", 3}, wantErr: "include entries must be strings"},
+		{name: "wrong type", inc: map[string]interface{}{"a": "b"}, wantErr: "include must be a path or list of paths"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := findIncludes(cfgPath, tc.inc)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, w := range tc.want {
+				want = append(want, filepath.Join(dir, w))
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEnvFlag(t *testing.T) {
+	t.Setenv("CANON_TEST_PASS", "host")
+	p := &Profile{Env: map[string]string{"A": "1", "B": "2"}}
+	for _, val := range []string{"B=3", "CANON_TEST_PASS", "C=4"} {
+		if err := (envFlag{p}).Set(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (envFlag{p}).Set("=1"); err == nil {
+		t.Error("expected an error for an empty name")
+	}
+
+	env, err := p.environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=1", "B=2"}; !slices.Equal(env, want) {
+		t.Errorf("got container environment %q, want %q", env, want)
+	}
+	env, err = p.execEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=1", "B=3", "C=4", "CANON_TEST_PASS=host"}; !slices.Equal(env, want) {
+		t.Errorf("got exec environment %q, want %q", env, want)
+	}
+
+	// the settings stored with a persistent container must not change
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "CANON_TEST_PASS") || strings.Contains(string(data), "C:") {
+		t.Errorf("-e values leaked into the profile settings:\n%s", data)
+	}
+}
+
+func TestFindProjectConfigs(t *testing.T) {
+	dir := t.TempDir()
+	inner := filepath.Join(dir, "outer", "inner")
+	if err := os.MkdirAll(inner, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inner, ".canon.yaml"), []byte("dev: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// a config that can't be checked (as with a parent directory the user can't read) ends the search
+	if err := os.Symlink(".canon.yaml", filepath.Join(dir, "outer", ".canon.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".canon.yaml"), []byte("dev: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(inner); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+
+	got, err := findProjectConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(inner, ".canon.yaml")}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -11,18 +11,24 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gopkg.in/yaml.v3"
 )
@@ -32,15 +38,27 @@ var canonSetupScript string
 
 var canonMountPoint = "/host"
 
+// Created by the setup script once the container is ready for commands to be run.
+const canonReadyMarker = "/.canon-ready"
+
 func removeContainer(ctx context.Context, cli *client.Client, containerID string) error {
 	return cli.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
 }
 
 func startContainer(ctx context.Context, cli *client.Client, profile *Profile, sshSock string) (string, error) {
+	env, err := profile.environment()
+	if err != nil {
+		return "", err
+	}
+
+	// use the exact image from the project's lock file, if there is one
+	img := pinnedImage(ImageDef{Image: profile.Image, Platform: "linux/" + profile.Arch})
+
 	cfg := &container.Config{
-		Image:        profile.Image,
+		Image:        img.Image,
 		AttachStdout: true,
 		AttachStderr: true,
+		Env:          env,
 	}
 
 	hostCfg := &container.HostConfig{AutoRemove: !profile.Persistent}
@@ -78,7 +96,7 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 				ReadOnly: true,
 			}
 			hostCfg.Mounts = append(hostCfg.Mounts, mnt)
-			cfg.Env = []string{"CANON_SSH=true"}
+			cfg.Env = append(cfg.Env, "CANON_SSH=true")
 		}
 	}
 
@@ -126,6 +144,18 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 	}
 	hostCfg.Mounts = append(hostCfg.Mounts, mnt)
 
+	extraMounts, err := profileMounts(profile)
+	if err != nil {
+		return "", err
+	}
+	hostCfg.Mounts = append(hostCfg.Mounts, extraMounts...)
+
+	caches, err := cacheMounts(ctx, cli, profile)
+	if err != nil {
+		return "", err
+	}
+	hostCfg.Mounts = append(hostCfg.Mounts, caches...)
+
 	// label the image with the running profile data
 	profYaml, err := yaml.Marshal(profile)
 	if err != nil {
@@ -139,16 +169,35 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 	}
 	if profile.Persistent {
 		cfg.Labels["com.viam.canon.type"] = "persistent"
+	} else {
+		for k, v := range ownerLabels() {
+			cfg.Labels[k] = v
+		}
+	}
+	namePrefix := "canon-" + profile.name
+	if profile.instance != "" {
+		cfg.Labels["com.viam.canon.instance"] = profile.instance
+		namePrefix += "-" + profile.instance
 	}
 
 	rando := rand.New(rand.NewSource(time.Now().UnixNano()))
-	name := fmt.Sprintf("canon-%s-%x", profile.name, rando.Uint32())
+	name := fmt.Sprintf("%s-%x", namePrefix, rando.Uint32())
 
 	// fill out the entrypoint template
 	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_USER__", profile.User)
 	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_GROUP__", profile.Group)
 	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_UID__", strconv.Itoa(os.Getuid()))
 	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_GID__", strconv.Itoa(os.Getgid()))
+	var quotedCaches []string
+	for _, c := range cacheTargets(profile) {
+		quotedCaches = append(quotedCaches, "'"+strings.ReplaceAll(c, "'", `'\''`)+"'")
+	}
+	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_CACHES__", strings.Join(quotedCaches, " "))
+	var idleTimeout int
+	if profile.Persistent {
+		idleTimeout = int(profile.IdleTimeout.Seconds())
+	}
+	canonSetupScript = strings.ReplaceAll(canonSetupScript, "__CANON_IDLE_TIMEOUT__", strconv.Itoa(idleTimeout))
 	cfg.Entrypoint = []string{}
 	cfg.Cmd = []string{"bash", "-c", canonSetupScript}
 
@@ -156,7 +205,7 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 	if err != nil {
 		// if we don't have the image or have the wrong architecture, we have to pull it
 		if strings.Contains(err.Error(), "does not match the specified platform") || strings.Contains(err.Error(), "No such image") {
-			err2 := update(ImageDef{Image: cfg.Image, Platform: platform.OS + "/" + platform.Architecture})
+			_, err2 := update(ctx, ImageDef{Image: cfg.Image, Platform: platform.OS + "/" + platform.Architecture})
 			if err2 != nil {
 				return "", err2
 			}
@@ -178,7 +227,8 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 
 	hijack, err := cli.ContainerAttach(ctx, containerID, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
 	if err != nil {
-		return "", err
+		// still return the ID, so the caller can clean up
+		return containerID, err
 	}
 	defer hijack.Close()
 
@@ -188,24 +238,106 @@ func startContainer(ctx context.Context, cli *client.Client, profile *Profile, s
 	}
 
 	// docker attach multiplexes stdout and stderr with a custom byte stream, we have to de-multiplex to strip the extra bytes
-	pipeR, pipeW := io.Pipe()
-	bufR := bufio.NewReader(pipeR)
 	go func() {
-		_, err := stdcopy.StdCopy(pipeW, pipeW, hijack.Reader)
+		_, err := stdcopy.StdCopy(os.Stdout, os.Stdout, hijack.Reader)
 		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 			printIfErr(err)
 		}
 	}()
 
-	scanner := bufio.NewScanner(bufR)
-	for scanner.Scan() {
-		output := scanner.Text()
-		fmt.Println(output)
-		if strings.Contains(output, "CANON_READY") {
-			break
+	return containerID, waitForSetup(ctx, cli, containerID, profile.SetupTimeout)
+}
+
+// waitForSetup waits for the setup script to create its ready marker, failing if the container exits first or if it
+// takes longer than timeout (when non-zero.)
+func waitForSetup(ctx context.Context, cli *client.Client, containerID string, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadline:
+			return fmt.Errorf("container setup did not finish within %s, see the setup output above (or raise setup_timeout)", timeout)
+		case <-ticker.C:
+		}
+
+		info, err := cli.ContainerInspect(ctx, containerID)
+		if errdefs.IsNotFound(err) {
+			return errors.New("container exited and was removed during setup, see the setup output above")
+		}
+		if err != nil {
+			return err
+		}
+		if info.State != nil && !info.State.Running {
+			return fmt.Errorf("container exited with code %d during setup, see the setup output above", info.State.ExitCode)
+		}
+
+		stat, err := cli.ContainerStatPath(ctx, containerID, canonReadyMarker)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// a marker left over from before a restart doesn't count
+		started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt)
+		if err != nil || !stat.Mtime.Before(started) {
+			return nil
 		}
 	}
-	return containerID, scanner.Err()
+}
+
+// profileMounts converts the profile's extra mounts to docker mounts, expanding ~ and project-relative paths.
+func profileMounts(profile *Profile) ([]mount.Mount, error) {
+	var mounts []mount.Mount
+	for _, m := range profile.Mounts {
+		// TODO check inside the container for the actual home directory
+		target := expandHome(m.Target, "/home/"+profile.User)
+		if m.Type == "volume" {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeVolume,
+				Source:   m.Source,
+				Target:   target,
+				ReadOnly: m.ReadOnly,
+			})
+			continue
+		}
+
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		source := expandHome(m.Source, home)
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(profile.Path, source)
+		}
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("cannot bind mount %s to %s: %w", source, target, err)
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   source,
+			Target:   target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	return mounts, nil
+}
+
+func expandHome(path, home string) string {
+	if path == "~" {
+		return home
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
 }
 
 func stop(ctx context.Context, profile *Profile, all, terminate bool) error {
@@ -223,21 +355,37 @@ func stop(ctx context.Context, profile *Profile, all, terminate bool) error {
 	if err != nil {
 		return err
 	}
+	if !all {
+		containers = filterInstance(containers, profile.instance)
+	}
 	if len(containers) > 1 && !all {
 		return errors.New("multiple matching containers found, please retry with '--all' option")
 	}
 	for _, c := range containers {
+		desc := c.Labels["com.viam.canon.profile"]
+		if instance := c.Labels["com.viam.canon.instance"]; instance != "" {
+			desc += " (instance " + instance + ")"
+		}
 		if terminate {
-			fmt.Printf("terminating %s\n", c.Labels["com.viam.canon.profile"])
+			fmt.Printf("terminating %s\n", desc)
 			err = errors.Join(err, cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}))
 		} else {
-			fmt.Printf("stopping %s\n", c.Labels["com.viam.canon.profile"])
+			fmt.Printf("stopping %s\n", desc)
 			err = errors.Join(err, cli.ContainerStop(ctx, c.ID, container.StopOptions{}))
 		}
 	}
 	return err
 }
 
+type containerInfo struct {
+	State       string `json:"state"        yaml:"state"`
+	Type        string `json:"type"         yaml:"type"`
+	Profile     string `json:"profile"      yaml:"profile"`
+	Instance    string `json:"instance"     yaml:"instance"`
+	Image       string `json:"image"        yaml:"image"`
+	ContainerID string `json:"container_id" yaml:"container_id"`
+}
+
 func list(ctx context.Context) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -249,29 +397,78 @@ func list(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if len(containers) == 0 {
-		fmt.Println("No canon containers found.")
-		return nil
-	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 8, 0, '\t', 0)
-	fmt.Fprintln(w, "State\tProfile/Arch\tImage\tContainerID")
-	fmt.Fprintln(w, "-----\t------------\t-----\t-----------")
+	infos := []containerInfo{}
 	for _, c := range containers {
 		state := c.State
 		switch state {
 		case "running":
 			if label, ok := c.Labels["com.viam.canon.type"]; ok && label == "one-shot" {
 				state = "oneshot"
+				if isOrphaned(c) {
+					state = "orphaned"
+				}
 			}
 		case "exited":
 			state = "stopped"
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", state, c.Labels["com.viam.canon.profile"], c.Image, c.ID)
+		infos = append(infos, containerInfo{
+			State:       state,
+			Type:        c.Labels["com.viam.canon.type"],
+			Profile:     c.Labels["com.viam.canon.profile"],
+			Instance:    c.Labels["com.viam.canon.instance"],
+			Image:       c.Image,
+			ContainerID: c.ID,
+		})
+	}
+
+	if structuredOutput() {
+		return printStructured(infos)
+	}
+
+	if len(infos) == 0 {
+		fmt.Println("No canon containers found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "State\tProfile/Arch\tInstance\tImage\tContainerID")
+	fmt.Fprintln(w, "-----\t------------\t--------\t-----\t-----------")
+	for _, c := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.State, c.Profile, c.Instance, c.Image, c.ContainerID)
 	}
 	return w.Flush()
 }
 
+// findContainer returns the running canon container matching an ID (or unique prefix), name, or profile (with optional /arch).
+func findContainer(ctx context.Context, cli *client.Client, target string) (types.Container, error) {
+	f := filters.NewArgs(filters.Arg("label", "com.viam.canon.profile"), filters.Arg("status", "running"))
+	containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: f})
+	if err != nil {
+		return types.Container{}, err
+	}
+
+	var matches []types.Container
+	for _, c := range containers {
+		profile := c.Labels["com.viam.canon.profile"]
+		profName, _, _ := strings.Cut(profile, "/")
+		if strings.HasPrefix(c.ID, target) || slices.Contains(c.Names, "/"+target) || profile == target || profName == target {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return types.Container{}, fmt.Errorf("no running canon container matches %s, see 'canon list'", target)
+	}
+	if len(matches) > 1 {
+		var ids []string
+		for _, c := range matches {
+			ids = append(ids, c.ID[:12])
+		}
+		return types.Container{}, fmt.Errorf("multiple running canon containers %s match %s, please use a container ID", ids, target)
+	}
+	return matches[0], nil
+}
+
 func getPersistentContainer(ctx context.Context, cli *client.Client, profile *Profile) (string, error) {
 	f := filters.NewArgs()
 	f.Add("label", "com.viam.canon.type=persistent")
@@ -280,6 +477,7 @@ func getPersistentContainer(ctx context.Context, cli *client.Client, profile *Pr
 	if err != nil {
 		return "", err
 	}
+	containers = filterInstance(containers, profile.instance)
 	if len(containers) > 1 {
 		return "", fmt.Errorf("more than one container exists for profile %s, please terminate all containers and retry", profile.name)
 	}
@@ -298,24 +496,239 @@ func getPersistentContainer(ctx context.Context, cli *client.Client, profile *Pr
 	}
 
 	if profYaml != string(curProfYaml) {
-		return "", fmt.Errorf(
-			"existing container settings for %s don't match current settings, please terminate all containers and retry",
-			profile.name,
-		)
+		diff, err := profileDiff(profYaml, string(curProfYaml))
+		if err != nil {
+			return "", err
+		}
+		if len(diff) > 0 {
+			recreate, err := confirmRecreate(profile, diff)
+			if err != nil {
+				return "", err
+			}
+			if !recreate {
+				return "", fmt.Errorf(
+					"existing container settings for %s don't match current settings, please terminate all containers and retry",
+					profile.name,
+				)
+			}
+			fmt.Printf("terminating %s to recreate it with the new settings\n", containers[0].Labels["com.viam.canon.profile"])
+			// caches are in volumes, so they survive the old container's removal
+			return "", removeContainer(ctx, cli, containers[0].ID)
+		}
 	}
 
-	return containers[0].ID, cli.ContainerStart(ctx, containers[0].ID, container.StartOptions{})
+	if containers[0].State == "running" {
+		return containers[0].ID, nil
+	}
+	if err := cli.ContainerStart(ctx, containers[0].ID, container.StartOptions{}); err != nil {
+		return "", err
+	}
+	// a stopped container runs setup again on start, but ones created by older canon versions never write the marker
+	if !strings.Contains(containers[0].Command, canonReadyMarker) {
+		return containers[0].ID, nil
+	}
+	err = waitForSetup(ctx, cli, containers[0].ID, profile.SetupTimeout)
+	if err != nil && ctx.Err() == nil {
+		// unlike a new container, the setup output wasn't shown as it ran
+		printIfErr(printSetupLogs(ctx, cli, containers[0].ID))
+	}
+	return containers[0].ID, err
+}
+
+// printSetupLogs prints a container's output since it was last started.
+func printSetupLogs(ctx context.Context, cli *client.Client, containerID string) error {
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	logs, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Since:      info.State.StartedAt,
+	})
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	_, err = stdcopy.StdCopy(os.Stderr, os.Stderr, logs)
+	return err
+}
+
+// Profile fields that don't affect the container itself, and so are ignored when checking for changed settings.
+var recreateIgnoredFields = []string{"recreate_on_change", "auto_upgrade", "setup_timeout"}
+
+// profileDiff compares two yaml encoded profiles, returning a line for each (container affecting) field that differs.
+func profileDiff(oldYaml, newYaml string) ([]string, error) {
+	oldProf := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(oldYaml), oldProf); err != nil {
+		return nil, err
+	}
+	newProf := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(newYaml), newProf); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for k := range oldProf {
+		keys[k] = true
+	}
+	for k := range newProf {
+		keys[k] = true
+	}
+
+	var diff []string
+	for k := range keys {
+		if slices.Contains(recreateIgnoredFields, k) || reflect.DeepEqual(oldProf[k], newProf[k]) {
+			continue
+		}
+		oldVal, newVal := "(unset)", "(unset)"
+		if v, ok := oldProf[k]; ok {
+			oldVal = fmt.Sprintf("%v", v)
+		}
+		if v, ok := newProf[k]; ok {
+			newVal = fmt.Sprintf("%v", v)
+		}
+		diff = append(diff, fmt.Sprintf("  %s: %s -> %s", k, oldVal, newVal))
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
+
+// confirmRecreate shows what changed in a persistent container's settings, and decides (per recreate_on_change,
+// asking if needed) whether it should be recreated.
+func confirmRecreate(profile *Profile, diff []string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "Settings for persistent container %s have changed:\n%s\n", profile.name, strings.Join(diff, "\n"))
+
+	switch profile.RecreateOnChange {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	}
+
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprintln(os.Stderr, "Not asking to recreate it without a terminal, set 'recreate_on_change: always' to do so automatically.")
+		return false, nil
+	}
+	fmt.Fprint(os.Stderr, "Terminate and recreate the container? Anything not in /host or caches will be lost. [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// filterInstance returns only the containers for the named instance, where containers without an instance label
+// are the default ("") instance.
+func filterInstance(containers []types.Container, instance string) []types.Container {
+	var out []types.Container
+	for _, c := range containers {
+		if c.Labels["com.viam.canon.instance"] == instance {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// activeExecs returns the number of exec sessions (canon shells or commands) still running in a container.
+func activeExecs(ctx context.Context, cli *client.Client, containerID string) (int, error) {
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return 0, err
+	}
+	var running int
+	for _, execID := range info.ExecIDs {
+		details, err := cli.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			// execs can be cleaned up between listing and inspecting them
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return 0, err
+		}
+		if details.Running {
+			running++
+		}
+	}
+	return running, nil
 }
 
-func checkContainerImageVersion(ctx context.Context, cli *client.Client, containerID string) (bool, error) {
+// upgrade pulls the latest image for a persistent profile, and if its container is out of date, waits for all
+// sessions in it to exit before recreating it on the new image.
+func upgrade(ctx context.Context, profile *Profile) error {
+	if !profile.Persistent {
+		return fmt.Errorf("profile %s is not persistent, its containers always use the latest image", profile.name)
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	if _, err := checkUpdate(ctx, profile, false, true, false); err != nil {
+		return err
+	}
+
+	containerID, err := getPersistentContainer(ctx, cli, profile)
+	if err != nil {
+		return err
+	}
+	if containerID == "" {
+		fmt.Printf("No persistent container for %s, nothing to upgrade.\n", profile.name)
+		return nil
+	}
+	needsUpdate, err := checkContainerImageVersion(ctx, cli, containerID, profile)
+	if err != nil {
+		return err
+	}
+	if !needsUpdate {
+		fmt.Printf("Persistent container for %s is already using the latest image.\n", profile.name)
+		return nil
+	}
+
+	var waiting bool
+	for {
+		sessions, err := activeExecs(ctx, cli, containerID)
+		if err != nil {
+			return err
+		}
+		if sessions == 0 {
+			break
+		}
+		if !waiting {
+			fmt.Printf("Waiting for %d active session(s) in the container to exit...\n", sessions)
+			waiting = true
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	fmt.Printf("Upgrading persistent container for %s to the new image.\n", profile.name)
+	if err := removeContainer(ctx, cli, containerID); err != nil {
+		return err
+	}
+	var sshSock string
+	if profile.SSH {
+		sshSock = getSSHSock()
+	}
+	_, err = startContainer(ctx, cli, profile, sshSock)
+	return err
+}
+
+// checkContainerImageVersion checks if a container is running a different image than its profile would use now, such
+// as after an update, or a change to the project's lock file.
+func checkContainerImageVersion(ctx context.Context, cli *client.Client, containerID string, profile *Profile) (bool, error) {
 	info, err := cli.ContainerInspect(ctx, containerID)
 	if err != nil {
 		return false, err
 	}
 
 	containerImageID := info.Image
-	imageName := info.Config.Image
+	imageName := pinnedImage(ImageDef{Image: profile.Image, Platform: "linux/" + profile.Arch}).Image
 	imageInfo, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if errdefs.IsNotFound(err) {
+		// a newly locked image that hasn't been pulled yet
+		return true, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestProfileDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldYaml string
+		newYaml string
+		want    []string
+	}{
+		{
+			name:    "unchanged",
+			oldYaml: "image: alpine\npersistent: true\n",
+			newYaml: "persistent: true\nimage: alpine\n",
+		},
+		{
+			name:    "changed, added, and removed",
+			oldYaml: "image: alpine\nuser: builder\nenv:\n  A: \"1\"\n",
+			newYaml: "image: ubuntu\nenv:\n  A: \"1\"\npass_env: [GO*]\n",
+			want: []string{
+				"  image: alpine -> ubuntu",
+				"  pass_env: (unset) -> [GO*]",
+				"  user: builder -> (unset)",
+			},
+		},
+		{
+			name:    "nested change",
+			oldYaml: "env:\n  A: \"1\"\n",
+			newYaml: "env:\n  A: \"2\"\n",
+			want:    []string{"  env: map[A:1] -> map[A:2]"},
+		},
+		{
+			name:    "ignored fields",
+			oldYaml: "recreate_on_change: ask\nauto_upgrade: false\nsetup_timeout: 1m0s\n",
+			newYaml: "recreate_on_change: always\nauto_upgrade: true\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := profileDiff(tc.oldYaml, tc.newYaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := profileDiff("image: [", "image: alpine"); err == nil {
+		t.Error("expected an error for invalid yaml")
+	}
+}
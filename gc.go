@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// ownerLabels identify the canon process that started a one-shot container, so it can be cleaned up if that process dies.
+// Without a hostname, the container is never considered orphaned.
+func ownerLabels() map[string]string {
+	labels := map[string]string{
+		"com.viam.canon.pid":     strconv.Itoa(os.Getpid()),
+		"com.viam.canon.boot-id": hostBootID(),
+	}
+	if host, err := os.Hostname(); err == nil {
+		labels["com.viam.canon.host"] = host
+	}
+	return labels
+}
+
+// isOrphaned checks if a one-shot container's owning canon process is gone. Containers started on other hosts, or
+// by older canon versions without owner labels, are never considered orphaned.
+func isOrphaned(c types.Container) bool {
+	if c.Labels["com.viam.canon.type"] != "one-shot" {
+		return false
+	}
+	pid, err := strconv.Atoi(c.Labels["com.viam.canon.pid"])
+	if err != nil {
+		return false
+	}
+	host, err := os.Hostname()
+	if err != nil || c.Labels["com.viam.canon.host"] != host {
+		return false
+	}
+	bootID := hostBootID()
+	if bootID != "" && c.Labels["com.viam.canon.boot-id"] != bootID {
+		// the host rebooted since the container was started
+		return true
+	}
+	err = syscall.Kill(pid, 0)
+	return errors.Is(err, syscall.ESRCH)
+}
+
+// gc removes one-shot containers whose canon process was killed before it could remove them.
+func gc(ctx context.Context, quiet bool) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	f := filters.NewArgs(filters.Arg("label", "com.viam.canon.type=one-shot"))
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for _, c := range containers {
+		if !isOrphaned(c) {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "removing orphaned one-shot container %s (%s)\n", c.ID[:12], c.Labels["com.viam.canon.profile"])
+		err = errors.Join(err, removeContainer(ctx, cli, c.ID))
+		removed++
+	}
+	if removed == 0 && !quiet {
+		fmt.Println("No orphaned canon containers found.")
+	}
+	return err
+}
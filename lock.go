@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+)
+
+const imageLockFileName = ".canon.lock"
+
+// ImageLock pins images (per platform) to content digests.
+type ImageLock struct {
+	Images map[ImageDef]string `yaml:"images"`
+}
+
+// Merged from the lock files next to all project configs, inner projects overriding outer ones.
+var lockedImages = make(map[ImageDef]string)
+
+// readImageLocks loads the lock files for the given project configs.
+func readImageLocks(cfgFiles []string) error {
+	for _, cfgFile := range cfgFiles {
+		lock, err := readImageLock(filepath.Join(filepath.Dir(cfgFile), imageLockFileName))
+		if err != nil {
+			return err
+		}
+		for i, d := range lock.Images {
+			lockedImages[i] = d
+		}
+	}
+	return nil
+}
+
+func readImageLock(path string) (*ImageLock, error) {
+	lock := &ImageLock{Images: make(map[ImageDef]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[ImageDef]string)
+	}
+	for i, d := range lock.Images {
+		if _, err := digest.Parse(d); err != nil {
+			return nil, fmt.Errorf("%s: invalid digest for %s|%s: %w", path, i.Image, i.Platform, err)
+		}
+	}
+	return lock, nil
+}
+
+// pinnedImage returns the image with its tag replaced by the locked digest, if the image is in a lock file.
+func pinnedImage(i ImageDef) ImageDef {
+	d, ok := lockedImages[i]
+	if !ok {
+		return i
+	}
+	return ImageDef{Image: pinnedImageRef(i.Image, d), Platform: i.Platform}
+}
+
+// pinnedImageRef replaces the tag of an image reference with a digest, returning the image as is if either is invalid.
+func pinnedImageRef(img, d string) string {
+	named, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		return img
+	}
+	// digests are validated when the lock file is read
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), digest.Digest(d))
+	if err != nil {
+		return img
+	}
+	return reference.FamiliarString(pinned)
+}
+
+// lockImages resolves the images of all project profiles to digests, and writes them to the innermost project's lock
+// file. Images that are already locked keep their digest unless update is set.
+func lockImages(update bool) error {
+	if len(projectCfgFiles) == 0 {
+		return errors.New("no project config (.canon.yaml) found, the lock file is written next to it")
+	}
+	lockPath := filepath.Join(filepath.Dir(projectCfgFiles[len(projectCfgFiles)-1]), imageLockFileName)
+	oldLock, err := readImageLock(lockPath)
+	if err != nil {
+		return err
+	}
+
+	// the lock file is shared by the whole project, so the user's own overrides (including their defaults, and any
+	// profiles extended by project profiles) must not leak into it
+	userCfg := mergedCfg
+	mergedCfg = projectCfg
+	defer func() {
+		mergedCfg = userCfg
+	}()
+
+	// the project's defaults can set the image too, for any profile that doesn't set its own
+	names := []string{"defaults"}
+	for name := range projectProfiles {
+		names = append(names, name)
+	}
+
+	// a plain image is used on whatever arch each team member has, so it's locked for every platform it's available
+	// for, rather than only the arch of whoever ran the lock
+	var images []ImageDef
+	anyArch := make(map[string][]string)
+	for _, name := range names {
+		iface, ok := projectCfg[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		prof, err := resolveImageProfile(name, iface)
+		if err != nil {
+			return err
+		}
+		for _, i := range imageCandidates(prof) {
+			if i.Image == prof.Image {
+				if !slices.Contains(anyArch[i.Image], i.Platform) {
+					anyArch[i.Image] = append(anyArch[i.Image], i.Platform)
+				}
+			} else if !slices.Contains(images, i) {
+				images = append(images, i)
+			}
+		}
+	}
+	if len(images) == 0 && len(anyArch) == 0 {
+		return errors.New("no images found in the project's profiles")
+	}
+	sort.Slice(images, func(a, b int) bool {
+		return images[a].Image+"|"+images[a].Platform < images[b].Image+"|"+images[b].Platform
+	})
+	var anyArchImages []string
+	for img := range anyArch {
+		anyArchImages = append(anyArchImages, img)
+	}
+	sort.Strings(anyArchImages)
+
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	// entries for images no longer used by any profile are dropped
+	newLock := &ImageLock{Images: make(map[ImageDef]string)}
+	setLock := func(i ImageDef, d string) {
+		old, ok := oldLock.Images[i]
+		if !ok {
+			fmt.Printf("locked: %s|%s %s\n", i.Image, i.Platform, d)
+		} else if old != d {
+			fmt.Printf("updated: %s|%s %s -> %s\n", i.Image, i.Platform, old, d)
+		}
+		newLock.Images[i] = d
+	}
+	for _, img := range anyArchImages {
+		// keep an already locked image on its digest, but still add any platforms missing from the lock
+		query := img
+		if !update {
+			for i, d := range oldLock.Images {
+				if i.Image == img {
+					query = pinnedImageRef(img, d)
+					break
+				}
+			}
+		}
+		d, platforms, err := registryPlatforms(ctx, cli, query)
+		if err != nil {
+			return err
+		}
+		if len(platforms) == 0 {
+			// the registry doesn't say, so only lock the platforms the profiles are known to use
+			platforms = anyArch[img]
+		}
+		for _, platform := range platforms {
+			setLock(ImageDef{Image: img, Platform: platform}, d)
+		}
+	}
+	for _, i := range images {
+		if _, ok := newLock.Images[i]; ok {
+			continue
+		}
+		if old, ok := oldLock.Images[i]; ok && !update {
+			newLock.Images[i] = old
+			continue
+		}
+		d, err := registryDigest(ctx, cli, i)
+		if err != nil {
+			return err
+		}
+		setLock(i, d)
+	}
+
+	out, err := yaml.Marshal(newLock)
+	if err != nil {
+		return err
+	}
+	out = append([]byte("# Generated by 'canon lock', update with 'canon lock --update'\n"), out...)
+	if err := os.WriteFile(lockPath, out, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d image(s) to %s\n", len(newLock.Images), lockPath)
+	return nil
+}
+
+// registryDigest looks up the current digest of an image, checking the registry has it for the image's platform.
+func registryDigest(ctx context.Context, cli *client.Client, i ImageDef) (string, error) {
+	named, err := reference.ParseNormalizedNamed(i.Image)
+	if err != nil {
+		return "", err
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String(), nil
+	}
+
+	dist, err := cli.DistributionInspect(ctx, i.Image, "")
+	if err != nil {
+		return "", fmt.Errorf("could not look up %s in its registry: %w", i.Image, err)
+	}
+	if len(dist.Platforms) > 0 {
+		var found bool
+		for _, p := range dist.Platforms {
+			platform := p.OS + "/" + p.Architecture
+			if p.Variant != "" {
+				platform += "/" + p.Variant
+			}
+			if platform == i.Platform || p.OS+"/"+p.Architecture == i.Platform {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("image %s has no %s variant", i.Image, i.Platform)
+		}
+	}
+	return dist.Descriptor.Digest.String(), nil
+}
+
+// registryPlatforms looks up the current digest of an image, and the platforms (of those canon supports) the registry
+// has it for. The platforms are empty if the registry doesn't list them.
+func registryPlatforms(ctx context.Context, cli *client.Client, img string) (string, []string, error) {
+	dist, err := cli.DistributionInspect(ctx, img, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not look up %s in its registry: %w", img, err)
+	}
+	var platforms []string
+	for _, p := range dist.Platforms {
+		if platform, ok := canonPlatform(p.OS, p.Architecture, p.Variant); ok && !slices.Contains(platforms, platform) {
+			platforms = append(platforms, platform)
+		}
+	}
+	slices.Sort(platforms)
+	return dist.Descriptor.Digest.String(), platforms, nil
+}
+
+// canonPlatform converts a registry platform to the platform canon uses for an arch, if it's one canon supports.
+// Only arm has variants that canon tells apart, and only v6 at that.
+func canonPlatform(goos, arch, variant string) (string, bool) {
+	if goos != "linux" {
+		return "", false
+	}
+	if arch == "arm" && variant == "v6" {
+		arch = "arm/v6"
+	}
+	if validateArch(arch) != nil {
+		return "", false
+	}
+	return "linux/" + arch, true
+}
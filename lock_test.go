@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:4a5b1d8f3b3e7c8d8e1b56c1b8d0d0f6c6b5f8f1e7c2f0a1b9e6d3c4a5b6c7d8"
+
+func TestPinnedImage(t *testing.T) {
+	old := lockedImages
+	lockedImages = map[ImageDef]string{
+		{Image: "ubuntu:24.04", Platform: "linux/amd64"}:                      testDigest,
+		{Image: "ghcr.io/viamrobotics/canon:latest", Platform: "linux/arm64"}: testDigest,
+	}
+	t.Cleanup(func() { lockedImages = old })
+
+	tests := []struct {
+		in   ImageDef
+		want string
+	}{
+		{ImageDef{Image: "ubuntu:24.04", Platform: "linux/amd64"}, "ubuntu@" + testDigest},
+		{ImageDef{Image: "ghcr.io/viamrobotics/canon:latest", Platform: "linux/arm64"}, "ghcr.io/viamrobotics/canon@" + testDigest},
+		// locks are per platform
+		{ImageDef{Image: "ubuntu:24.04", Platform: "linux/arm64"}, "ubuntu:24.04"},
+		{ImageDef{Image: "alpine", Platform: "linux/amd64"}, "alpine"},
+	}
+	for _, tc := range tests {
+		got := pinnedImage(tc.in)
+		if got.Image != tc.want || got.Platform != tc.in.Platform {
+			t.Errorf("pinnedImage(%s|%s) = %s|%s, want %s|%s", tc.in.Image, tc.in.Platform, got.Image, got.Platform, tc.want, tc.in.Platform)
+		}
+	}
+}
+
+func TestReadImageLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[ImageDef]string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: "images:\n  ubuntu:24.04|linux/amd64: " + testDigest + "\n",
+			want: map[ImageDef]string{{Image: "ubuntu:24.04", Platform: "linux/amd64"}: testDigest},
+		},
+		{
+			name: "empty",
+			data: "",
+			want: map[ImageDef]string{},
+		},
+		{
+			name:    "invalid digest",
+			data:    "images:\n  ubuntu:24.04|linux/amd64: sha256:nope\n",
+			wantErr: "invalid digest for ubuntu:24.04|linux/amd64",
+		},
+		{
+			name:    "missing platform",
+			data:    "images:\n  ubuntu:24.04: " + testDigest + "\n",
+			wantErr: "did not split into image and platform",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), imageLockFileName)
+			if err := os.WriteFile(path, []byte(tc.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			lock, err := readImageLock(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lock.Images) != len(tc.want) {
+				t.Fatalf("got %v, want %v", lock.Images, tc.want)
+			}
+			for i, d := range tc.want {
+				if lock.Images[i] != d {
+					t.Errorf("got %v, want %v", lock.Images, tc.want)
+				}
+			}
+		})
+	}
+
+	lock, err := readImageLock(filepath.Join(t.TempDir(), imageLockFileName))
+	if err != nil || len(lock.Images) != 0 {
+		t.Errorf("a missing lock file should be empty, got %v, %v", lock, err)
+	}
+}
+
+func TestCanonPlatform(t *testing.T) {
+	tests := []struct {
+		goos, arch, variant string
+		want                string
+		wantOK              bool
+	}{
+		{"linux", "amd64", "", "linux/amd64", true},
+		{"linux", "arm64", "v8", "linux/arm64", true},
+		{"linux", "arm", "v7", "linux/arm", true},
+		{"linux", "arm", "v6", "linux/arm/v6", true},
+		{"linux", "386", "", "linux/386", true},
+		{"linux", "s390x", "", "", false},
+		{"windows", "amd64", "", "", false},
+		{"unknown", "unknown", "", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := canonPlatform(tc.goos, tc.arch, tc.variant)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("canonPlatform(%s, %s, %s) = %q, %v, want %q, %v", tc.goos, tc.arch, tc.variant, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
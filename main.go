@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 var defaultArgs = []string{"bash", "-l"}
@@ -19,6 +21,10 @@ func main() {
 	if err != nil {
 		printIfErr(err)
 		exitCode = ExitCodeOnError
+		// the parse error only covers the first problem, so still report everything when validating
+		if isValidateCmd(os.Args[1:]) {
+			printIfErr(validateConfigs())
+		}
 		return
 	}
 
@@ -34,9 +40,60 @@ func main() {
 			exitCode, err = shell(defaultArgs)
 			printIfErr(err)
 		case "config":
-			showConfig(activeProfile)
+			if len(args) > 1 && args[1] == "validate" {
+				err = validateConfigs()
+				if err != nil {
+					exitCode = ExitCodeOnError
+					printIfErr(err)
+				}
+				break
+			}
+			if len(args) > 1 && args[1] == "schema" {
+				err = showSchema()
+				if err != nil {
+					exitCode = ExitCodeOnError
+					printIfErr(err)
+				}
+				break
+			}
+			err = showConfig(activeProfile, hasArg(args[1:], "explain"))
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
 		case "update":
-			err = checkUpdate(activeProfile, checkAll(args), true)
+			var results []UpdateResult
+			results, err = checkUpdate(context.Background(), activeProfile, checkAll(args), true, hasArg(args[1:], "rebuild"))
+			if structuredOutput() {
+				printIfErr(printStructured(results))
+			}
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
+		case "lock":
+			err = lockImages(hasArg(args[1:], "update"))
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
+		case "profiles":
+			if hasArg(args[1:], "json") {
+				outputFormat = "json"
+			}
+			err = listProfiles()
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
+		case "gc":
+			err = gc(context.Background(), false)
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
+		case "upgrade":
+			err = upgrade(context.Background(), activeProfile)
 			if err != nil {
 				exitCode = ExitCodeOnError
 				printIfErr(err)
@@ -59,6 +116,24 @@ func main() {
 				exitCode = ExitCodeOnError
 				printIfErr(err)
 			}
+		case "cache":
+			err = cacheCommand(context.Background(), activeProfile, args[1:])
+			if err != nil {
+				exitCode = ExitCodeOnError
+				printIfErr(err)
+			}
+		case "exec":
+			if len(args) < 2 {
+				exitCode = ExitCodeOnError
+				printIfErr(errors.New("exec needs a container ID, name, or profile"))
+				break
+			}
+			cmd := args[2:]
+			if len(cmd) > 0 && cmd[0] == "--" {
+				cmd = cmd[1:]
+			}
+			exitCode, err = execInto(args[1], cmd)
+			printIfErr(err)
 		case "--":
 			fallthrough
 		case "run":
@@ -71,6 +146,19 @@ func main() {
 	}
 }
 
+// isValidateCmd checks if the command (after any options) is "config validate", for when the options couldn't be parsed.
+func isValidateCmd(args []string) bool {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "--" {
+		name := strings.TrimLeft(args[0], "-")
+		args = args[1:]
+		// options other than booleans take the next arg as their value, unless given as -name=value
+		if !strings.Contains(name, "=") && name != "ssh" && name != "netrc" && len(args) > 0 {
+			args = args[1:]
+		}
+	}
+	return len(args) >= 2 && args[0] == "config" && args[1] == "validate"
+}
+
 func printIfErr(err error) {
 	if err == nil {
 		return
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidateCmd(t *testing.T) {
+	tests := []struct {
+		args string
+		want bool
+	}{
+		{"config validate", true},
+		{"-profile dev config validate", true},
+		{"--config=/tmp/c.yaml -ssh config validate", true},
+		{"-netrc -e FOO=1 config validate", true},
+		{"config", false},
+		{"config schema", false},
+		{"run echo config validate", false},
+		{"echo config validate", false},
+		{"-- config validate", false},
+		{"-profile config validate", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := isValidateCmd(strings.Fields(tc.args)); got != tc.want {
+			t.Errorf("isValidateCmd(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
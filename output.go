@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Set by the global -output option.
+var outputFormat = "table"
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case "table", "json", "yaml":
+		return nil
+	default:
+		return fmt.Errorf("invalid output format %q; use \"table\", \"json\", or \"yaml\"", format)
+	}
+}
+
+// structuredOutput is true when results should be printed for scripts rather than people.
+func structuredOutput() bool {
+	return outputFormat != "table"
+}
+
+// progressOutput is where human-oriented progress messages go, so they don't mix with structured output on stdout.
+func progressOutput() io.Writer {
+	if structuredOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// printStructured prints v to stdout in the selected json or yaml format.
+func printStructured(v interface{}) error {
+	var out []byte
+	var err error
+	if outputFormat == "yaml" {
+		out, err = yaml.Marshal(v)
+	} else {
+		out, err = json.MarshalIndent(v, "", "  ")
+		out = append(out, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type profileInfo struct {
+	Name       string            `json:"name"       yaml:"name"`
+	Selected   bool              `json:"selected"   yaml:"selected"`
+	Persistent bool              `json:"persistent" yaml:"persistent"`
+	Path       string            `json:"path"       yaml:"path"`
+	Images     map[string]string `json:"images"     yaml:"images"`
+	Files      []string          `json:"files"      yaml:"files"`
+}
+
+// getProfileInfos resolves every profile in the merged config, marking the one that would be auto-selected.
+func getProfileInfos() ([]profileInfo, error) {
+	defProfileName, _, err := getDefaultProfile(mergedCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: cannot determine the auto-selected profile: %v\n", err)
+	}
+
+	var names []string
+	for name, p := range mergedCfg {
+		if _, ok := p.(map[string]interface{}); ok && name != "defaults" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	infos := []profileInfo{}
+	for _, name := range names {
+		prof, err := newProfile(true)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeProfile(name, mergedCfg[name], prof); err != nil {
+			// keep listing the rest, one broken profile shouldn't hide them
+			fmt.Fprintf(os.Stderr, "WARNING: skipping profile %s: %v\n", name, err)
+			continue
+		}
+
+		images := make(map[string]string)
+		for arch, img := range map[string]string{
+			"amd64":  prof.ImageAMD64,
+			"arm64":  prof.ImageARM64,
+			"arm":    prof.ImageARM,
+			"arm/v6": prof.ImageARMv6,
+			"386":    prof.Image386,
+		} {
+			if img != "" {
+				images[arch] = img
+			}
+		}
+		if prof.Image != "" {
+			images["any"] = prof.Image
+		}
+
+		infos = append(infos, profileInfo{
+			Name:       name,
+			Selected:   name == defProfileName,
+			Persistent: prof.Persistent,
+			Path:       prof.Path,
+			Images:     images,
+			Files:      cfgProfileFiles[name],
+		})
+	}
+	return infos, nil
+}
+
+func listProfiles() error {
+	infos, err := getProfileInfos()
+	if err != nil {
+		return err
+	}
+
+	if structuredOutput() {
+		return printStructured(infos)
+	}
+
+	if len(infos) == 0 {
+		fmt.Println("No profiles found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "Selected\tProfile\tPersistent\tPath\tImages\tFiles")
+	fmt.Fprintln(w, "--------\t-------\t----------\t----\t------\t-----")
+	for _, info := range infos {
+		selected := ""
+		if info.Selected {
+			selected = "*"
+		}
+		var images []string
+		for arch, img := range info.Images {
+			images = append(images, arch+"="+img)
+		}
+		sort.Strings(images)
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n",
+			selected, info.Name, info.Persistent, info.Path, strings.Join(images, ","), strings.Join(info.Files, ","))
+	}
+	return w.Flush()
+}
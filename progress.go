@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/term"
+)
+
+// pullProgress shows the status of several images being updated at once. On a terminal, each image gets a line that
+// is redrawn in place. Otherwise, only notable changes (such as starting a pull, or finishing) are logged, one per line.
+type pullProgress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	width    int
+	names    []string
+	statuses []string
+	drawn    int
+	lastDraw time.Time
+}
+
+func newPullProgress(out io.Writer, images []ImageDef) *pullProgress {
+	p := &pullProgress{out: out}
+	for _, i := range images {
+		p.names = append(p.names, i.Image+"|"+i.Platform)
+		p.statuses = append(p.statuses, "queued")
+	}
+	if f, ok := out.(*os.File); ok && term.IsTerminal(f.Fd()) {
+		p.tty = true
+		if ws, err := term.GetWinsize(f.Fd()); err == nil {
+			p.width = int(ws.Width)
+		}
+		p.draw()
+	}
+	return p
+}
+
+// reporter returns a function to update the status of the image at index idx.
+func (p *pullProgress) reporter(idx int) func(status string, notable bool) {
+	return func(status string, notable bool) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.statuses[idx] = strings.ReplaceAll(status, "\n", " ")
+		if !p.tty {
+			if notable {
+				fmt.Fprintf(p.out, "%s: %s\n", p.names[idx], p.statuses[idx])
+			}
+			return
+		}
+		// pulls send many progress updates, so only redraw a few times a second
+		if notable || time.Since(p.lastDraw) > 100*time.Millisecond {
+			p.draw()
+		}
+	}
+}
+
+// finish draws the final status of every image.
+func (p *pullProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		p.draw()
+	}
+}
+
+func (p *pullProgress) draw() {
+	if p.drawn > 0 {
+		// move back up to redraw over the previous lines
+		fmt.Fprintf(p.out, "\x1b[%dA", p.drawn)
+	}
+	for i, name := range p.names {
+		line := []rune(name + ": " + p.statuses[i])
+		// lines must not wrap, or moving back up would miss some
+		if p.width > 0 && len(line) >= p.width {
+			line = line[:p.width-1]
+		}
+		fmt.Fprintf(p.out, "\x1b[2K%s\n", string(line))
+	}
+	p.drawn = len(p.names)
+	p.lastDraw = time.Now()
+}
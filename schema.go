@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Allowed values for string fields, keyed by field name.
+var schemaEnums = map[string][]string{
+	"arch":               {"amd64", "arm64", "386", "arm", "arm/v6"},
+	"type":               {"bind", "volume"},
+	"recreate_on_change": {"ask", "always", "never"},
+}
+
+// Matches durations such as "1h30m", "1.5h", or "0".
+const durationPattern = `^(0|\+?(([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+)$`
+
+// showSchema prints a JSON Schema for canon config files, generated from the Profile struct.
+func showSchema() error {
+	profile := structSchema(reflect.TypeOf(Profile{}))
+
+	defaults := structSchema(reflect.TypeOf(Profile{}))
+	defaults["properties"].(map[string]interface{})["profile"] = map[string]interface{}{
+		"type":        "string",
+		"description": "profile to use when no project profile matches the current directory",
+	}
+
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "canon config",
+		"description": "canon project (.canon.yaml) or user (~/.config/canon.yaml) config; all other top-level keys are profiles",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"defaults": defaults,
+			"include": map[string]interface{}{
+				"description": "config files (relative to this file, globs allowed) to merge in before this one",
+				"anyOf": []interface{}{
+					map[string]interface{}{"type": "string"},
+					map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				},
+			},
+			"root": map[string]interface{}{
+				"type":        "boolean",
+				"description": "stop searching parent directories for further project configs",
+			},
+		},
+		"additionalProperties": profile,
+	}
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "" {
+			continue
+		}
+		prop := typeSchema(field.Type)
+		if enum, ok := schemaEnums[name]; ok {
+			prop["enum"] = enum
+		}
+		props[name] = prop
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		// as accepted by time.ParseDuration, other than negative durations, which are never valid
+		return map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "string", "pattern": durationPattern},
+			map[string]interface{}{"const": 0},
+		}}
+	case reflect.TypeOf(time.Time{}):
+		// YAML timestamps can be just a date, such as 2024-01-01
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "format": "date"},
+			map[string]interface{}{"type": "string", "format": "date-time"},
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice:
+		arr := map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+		if t.Elem().Kind() == reflect.String {
+			// a single value is accepted in place of a list (see stringToSliceHookFunc)
+			return map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "string"}, arr}}
+		}
+		return arr
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
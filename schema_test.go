@@ -0,0 +1,24 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestDurationPattern(t *testing.T) {
+	re := regexp.MustCompile(durationPattern)
+	for _, d := range []string{"0", "0s", "10m0s", "1h30m", "1.5h", ".5s", "1.s", "+2h", "300ms", "5us", "5µs", "5μs"} {
+		if _, err := time.ParseDuration(d); err != nil {
+			t.Fatalf("test case %q is not a valid duration: %v", d, err)
+		}
+		if !re.MatchString(d) {
+			t.Errorf("pattern rejects valid duration %q", d)
+		}
+	}
+	for _, d := range []string{"", "1", "10", "h", "1d", "-1h", "1h 30m", "abc"} {
+		if re.MatchString(d) {
+			t.Errorf("pattern accepts invalid duration %q", d)
+		}
+	}
+}
@@ -6,89 +6,248 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/moby/term"
+	"gopkg.in/yaml.v3"
 )
 
 const (
+	// Returned for internal or docker errors, as opposed to the exit code of the command run in the container.
 	ExitCodeOnError = 66
+	// Commands killed by a signal exit with this plus the signal number, as in shells.
+	ExitCodeSignalBase = 128
 )
 
-func shell(args []string) (int, error) {
+func shell(args []string) (exitCode int, err error) {
 	if len(args) < 1 {
 		return ExitCodeOnError, errors.New("shell needs at least one argument to run")
 	}
-	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return ExitCodeOnError, err
 	}
 
+	// until the command is running, a signal cancels setup (removing a one-shot container on the way out), and from
+	// then on runExec forwards signals to the command instead
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var setupSignal atomic.Int32
+	sigchan := make(chan os.Signal, 1)
+	notifyForwardedSignals(sigchan)
+	defer signal.Stop(sigchan)
+	handOff := make(chan struct{})
+	setupWatcher := make(chan struct{})
+	go func() {
+		defer close(setupWatcher)
+		for {
+			select {
+			case sig := <-sigchan:
+				if s, ok := sig.(syscall.Signal); ok {
+					setupSignal.Store(int32(s))
+				}
+				cancel()
+			case <-handOff:
+				return
+			}
+		}
+	}()
+	fail := func(err error) (int, error) {
+		if sig := setupSignal.Load(); sig != 0 {
+			return ExitCodeSignalBase + int(sig), fmt.Errorf("interrupted by %s during setup", syscall.Signal(sig))
+		}
+		return ExitCodeOnError, err
+	}
+
 	var sshSock string
 	if activeProfile.SSH {
-		if runtime.GOOS == "darwin" {
-			// Docker has magic paths for this on Mac
-			sshSock = "/run/host-services/ssh-auth.sock"
-		} else {
-			sshSock, _ = os.LookupEnv("SSH_AUTH_SOCK")
-		}
+		sshSock = getSSHSock()
+	}
+
+	_, err = checkUpdate(ctx, activeProfile, false, false, false)
+	var minErr *minimumDateError
+	var buildErr *buildError
+	if errors.As(err, &minErr) || errors.As(err, &buildErr) || ctx.Err() != nil {
+		return fail(err)
 	}
+	printIfErr(err)
 
-	printIfErr(checkUpdate(activeProfile, false, false))
+	// opportunistically clean up after any canon processes that were killed
+	printIfErr(gc(ctx, true))
 
 	var containerID string
 	if activeProfile.Persistent {
 		containerID, err = getPersistentContainer(ctx, cli, activeProfile)
 		if err != nil {
-			return ExitCodeOnError, err
+			return fail(err)
 		}
 	}
 
 	if containerID != "" {
-		needsUpdate, err := checkContainerImageVersion(ctx, cli, containerID)
+		needsUpdate, err := checkContainerImageVersion(ctx, cli, containerID, activeProfile)
 		if err != nil {
-			return ExitCodeOnError, err
+			return fail(err)
 		}
-		if needsUpdate {
+		if needsUpdate && activeProfile.AutoUpgrade {
+			sessions, err := activeExecs(ctx, cli, containerID)
+			if err != nil {
+				return fail(err)
+			}
+			if sessions == 0 {
+				fmt.Println("Upgrading persistent container to the new image.")
+				if err := removeContainer(ctx, cli, containerID); err != nil {
+					return fail(err)
+				}
+				containerID = ""
+			} else {
+				fmt.Printf("WARNING: Persistent container is using an out of date image, but has %d active session(s).\n"+
+					"WARNING: It will be upgraded once they have all exited.\n\n", sessions)
+			}
+		} else if needsUpdate {
 			fmt.Print(
 				"WARNING: Persistent container is using an out of date image.\n" +
-					"WARNING: Please terminate and restart to use the new version.\n\n",
+					"WARNING: Please run 'canon upgrade' (or terminate and restart) to use the new version.\n\n",
 			)
 		}
-	} else {
+	}
+
+	if containerID == "" {
 		containerID, err = startContainer(ctx, cli, activeProfile, sshSock)
+		if !activeProfile.Persistent && containerID != "" {
+			// remove the one-shot container on every way out, including errors and signals, even once ctx is canceled
+			defer func() {
+				if rmErr := removeContainer(context.WithoutCancel(ctx), cli, containerID); rmErr != nil {
+					exitCode = ExitCodeOnError
+					err = errors.Join(err, rmErr)
+				}
+			}()
+		}
 		if err != nil {
-			return ExitCodeOnError, err
+			return fail(err)
 		}
 	}
 
 	wd, err := getWorkingDir(activeProfile)
+	if err != nil {
+		return fail(err)
+	}
+
+	close(handOff)
+	<-setupWatcher
+	if ctx.Err() != nil {
+		// signaled just before handing off to runExec
+		return fail(ctx.Err())
+	}
+	return runExec(ctx, cli, containerID, activeProfile, wd, sshSock, args, sigchan)
+}
+
+// execInto runs a command in any running canon container, such as a one-shot container started from another terminal.
+func execInto(target string, args []string) (int, error) {
+	if len(args) < 1 {
+		args = defaultArgs
+	}
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return ExitCodeOnError, err
+	}
+
+	c, err := findContainer(ctx, cli, target)
+	if err != nil {
+		return ExitCodeOnError, err
+	}
+
+	// use the settings the container was started with, rather than the active profile
+	profile := &Profile{}
+	if err := yaml.Unmarshal([]byte(c.Labels["com.viam.canon.profile-data"]), profile); err != nil {
+		return ExitCodeOnError, fmt.Errorf("cannot read profile data from container %s: %w", c.ID[:12], err)
+	}
+	profile.name, _, _ = strings.Cut(c.Labels["com.viam.canon.profile"], "/")
+	profile.cliEnv, profile.cliPassEnv = activeProfile.cliEnv, activeProfile.cliPassEnv
+
+	wd, err := getWorkingDir(profile)
+	if err != nil {
+		wd = canonMountPoint
+	}
+
+	// only forward the agent if this terminal's socket is the one mounted in the container
+	var sshSock string
+	if profile.SSH {
+		hostSock := getSSHSock()
+		for _, m := range c.Mounts {
+			if hostSock != "" && m.Destination == hostSock {
+				sshSock = hostSock
+			}
+		}
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	notifyForwardedSignals(sigchan)
+	defer signal.Stop(sigchan)
+	return runExec(ctx, cli, c.ID, profile, wd, sshSock, args, sigchan)
+}
+
+// runExec runs a command in an already running container, attached to the current terminal, and returns its exit code.
+// Signals received on signals are forwarded to the command.
+func runExec(
+	ctx context.Context, cli *client.Client, containerID string, profile *Profile, wd, sshSock string, args []string,
+	signals <-chan os.Signal,
+) (int, error) {
+	env, err := profile.execEnvironment()
 	if err != nil {
 		return ExitCodeOnError, err
 	}
 
 	isTTY := term.IsTerminal(os.Stdin.Fd())
 
+	// wrap the command so its PID is known inside the container, for forwarding signals to it
+	rando := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pidFile := fmt.Sprintf("/tmp/.canon-exec-%x.pid", rando.Uint32())
+
+	// handled from before the command starts, so none are missed (forwardSignal waits for the PID file)
+	var lastSignal atomic.Int32
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if s, ok := sig.(syscall.Signal); ok {
+					lastSignal.Store(int32(s))
+				}
+				printIfErr(forwardSignal(ctx, cli, containerID, pidFile, sig))
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	execCfg := container.ExecOptions{
-		User:         fmt.Sprintf("%s:%s", activeProfile.User, activeProfile.Group),
+		User:         fmt.Sprintf("%s:%s", profile.User, profile.Group),
 		WorkingDir:   wd,
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
 		Tty:          isTTY,
-		Cmd:          args,
+		Cmd:          append([]string{"bash", "-c", `echo $$ > "$0" 2>/dev/null; exec "$@"`, pidFile}, args...),
+		Env:          env,
 	}
 	if sshSock != "" {
-		execCfg.Env = []string{"SSH_AUTH_SOCK=" + sshSock}
+		execCfg.Env = append(execCfg.Env, "SSH_AUTH_SOCK="+sshSock)
 	}
 
 	execResp, err := cli.ContainerExecCreate(ctx, containerID, execCfg)
@@ -147,45 +306,129 @@ func shell(args []string) (int, error) {
 		inErr <- err
 	}()
 
+	execStart := time.Now()
 	err = cli.ContainerExecStart(ctx, execID, container.ExecStartOptions{})
 	if err != nil {
 		return ExitCodeOnError, err
 	}
 
+	defer func() {
+		//nolint:errcheck // best effort cleanup, the container may already be gone
+		runDetached(ctx, cli, containerID, "rm", "-f", pidFile)
+	}()
+
+	var streamErr error
 	select {
-	case err := <-outErr:
-		if err != nil {
-			return ExitCodeOnError, err
-		}
-		break
-	case err := <-inErr:
-		if err != nil {
-			return ExitCodeOnError, err
-		}
-		select {
-		case err := <-outErr:
-			if err != nil {
-				return ExitCodeOnError, err
+	case streamErr = <-outErr:
+	case streamErr = <-inErr:
+		if streamErr == nil {
+			select {
+			case streamErr = <-outErr:
+			case <-ctx.Done():
+				streamErr = ctx.Err()
 			}
-		case <-ctx.Done():
-			return ExitCodeOnError, ctx.Err()
 		}
 	}
 
 	details, err := cli.ContainerExecInspect(ctx, execID)
 	if err != nil {
-		return ExitCodeOnError, err
+		if sig := lastSignal.Load(); sig != 0 {
+			// canon was signaled, and the container may have gone away with the command
+			return ExitCodeSignalBase + int(sig), errors.Join(streamErr, err)
+		}
+		return ExitCodeOnError, errors.Join(streamErr, err)
+	}
+	if details.Running {
+		return ExitCodeOnError, errors.Join(streamErr, errors.New("lost connection to the command running in the container"))
+	}
+	if streamErr != nil {
+		// the command finished, so its exit code is still meaningful even if some output was lost
+		printIfErr(streamErr)
 	}
 
-	if !activeProfile.Persistent {
-		err = removeContainer(ctx, cli, containerID)
+	if details.ExitCode == ExitCodeSignalBase+int(syscall.SIGKILL) {
+		// the container's OOMKilled state sticks until it restarts, so look for an OOM kill during this command instead
+		oom, err := oomKilledSince(ctx, cli, containerID, execStart)
 		if err != nil {
-			return ExitCodeOnError, err
+			return details.ExitCode, fmt.Errorf("command was killed (SIGKILL), and checking for an out of memory kill failed: %w", err)
+		}
+		if oom {
+			return details.ExitCode, errors.New("command was killed (SIGKILL) after the container ran out of memory, " +
+				"try allocating more memory to docker")
 		}
 	}
 	return details.ExitCode, nil
 }
 
+// oomKilledSince checks docker's event log for an out of memory kill in the container since the given time.
+func oomKilledSince(ctx context.Context, cli *client.Client, containerID string, since time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	f := filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("container", containerID),
+		filters.Arg("event", string(events.ActionOOM)),
+	)
+	// event times are in whole seconds, so the window is rounded outward
+	msgs, errs := cli.Events(ctx, events.ListOptions{
+		Since:   strconv.FormatInt(since.Unix(), 10),
+		Until:   strconv.FormatInt(time.Now().Unix()+1, 10),
+		Filters: f,
+	})
+	select {
+	case <-msgs:
+		return true, nil
+	case err := <-errs:
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+}
+
+// Names of the signals forwarded to commands, as understood by kill.
+var forwardedSignals = map[os.Signal]string{
+	syscall.SIGINT:  "INT",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGQUIT: "QUIT",
+}
+
+func notifyForwardedSignals(c chan<- os.Signal) {
+	for sig := range forwardedSignals {
+		signal.Notify(c, sig)
+	}
+}
+
+// forwardSignal sends a signal to the command running in a container, found via the PID file written by its wrapper.
+// A signal sent just as the command starts waits (briefly) for the PID file to be written, rather than being lost.
+func forwardSignal(ctx context.Context, cli *client.Client, containerID, pidFile string, sig os.Signal) error {
+	name, ok := forwardedSignals[sig]
+	if !ok {
+		return fmt.Errorf("cannot forward signal %s", sig)
+	}
+	script := `for ((i = 0; i < 50; i++)); do [[ -s "$1" ]] && break; sleep 0.1; done; kill -s "$0" "$(cat "$1")"`
+	return runDetached(ctx, cli, containerID, "bash", "-c", script, name, pidFile)
+}
+
+// runDetached starts a command as root in a container without waiting for it.
+func runDetached(ctx context.Context, cli *client.Client, containerID string, cmd ...string) error {
+	execResp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{User: "root", Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	return cli.ContainerExecStart(ctx, execResp.ID, container.ExecStartOptions{Detach: true})
+}
+
+func getSSHSock() string {
+	if runtime.GOOS == "darwin" {
+		// Docker has magic paths for this on Mac
+		return "/run/host-services/ssh-auth.sock"
+	}
+	sshSock, _ := os.LookupEnv("SSH_AUTH_SOCK")
+	return sshSock
+}
+
 func resizeTty(ctx context.Context, cli *client.Client, execID string) error {
 	termSize, err := term.GetWinsize(os.Stdout.Fd())
 	if err != nil {
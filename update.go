@@ -2,17 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
 	"gopkg.in/yaml.v3"
 )
 
@@ -44,12 +52,40 @@ func (i *ImageDef) UnmarshalYAML(n *yaml.Node) error {
 	return nil
 }
 
-type ImageCheckData map[ImageDef]time.Time
+type ImageCheckData map[ImageDef]ImageCheck
 
-func update(images ...ImageDef) error {
+// ImageCheck records when an image was last checked against its registry, and the digest it had then.
+type ImageCheck struct {
+	CheckedAt time.Time `yaml:"checked_at"`
+	Digest    string    `yaml:"digest,omitempty"`
+}
+
+// UnmarshalYAML unmarshals yaml, including the plain timestamps written by older canon versions.
+func (c *ImageCheck) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.CheckedAt)
+	}
+	type plain ImageCheck
+	return n.Decode((*plain)(c))
+}
+
+// UpdateResult reports the outcome of pulling a single image, for structured output.
+type UpdateResult struct {
+	Image     string    `json:"image"                yaml:"image"`
+	Platform  string    `json:"platform"             yaml:"platform"`
+	Status    string    `json:"status"               yaml:"status"`
+	Error     string    `json:"error,omitempty"      yaml:"error,omitempty"`
+	Digest    string    `json:"digest,omitempty"     yaml:"digest,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty" yaml:"checked_at,omitempty"`
+}
+
+// How many images (or rather, image names) are updated at once.
+const maxParallelPulls = 4
+
+func update(ctx context.Context, images ...ImageDef) ([]UpdateResult, error) {
 	lock, err := getLock()
 	if err != nil {
-		return err
+		return []UpdateResult{}, err
 	}
 	defer func() {
 		printIfErr(dropLock(lock))
@@ -57,32 +93,233 @@ func update(images ...ImageDef) error {
 
 	checkData, err := readCheckData()
 	if err != nil {
-		return err
+		return []UpdateResult{}, err
 	}
 
-	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return err
+		return []UpdateResult{}, err
 	}
 
-	for _, i := range images {
-		resp, err := cli.ImagePull(ctx, i.Image, image.PullOptions{Platform: i.Platform})
-		if err != nil {
-			return err
+	// images sharing a name (for different platforms) share a local tag, so they're pulled one after the other
+	var groups [][]int
+	groupOf := make(map[string]int)
+	for idx, i := range images {
+		g, ok := groupOf[i.Image]
+		if !ok {
+			g = len(groups)
+			groupOf[i.Image] = g
+			groups = append(groups, nil)
 		}
-		defer resp.Close()
-		err = jsonmessage.DisplayJSONMessagesStream(resp, os.Stdout, os.Stdout.Fd(), true, nil)
-		if err != nil {
-			return err
+		groups[g] = append(groups[g], idx)
+	}
+
+	results := make([]UpdateResult, len(images))
+	errs := make([]error, len(images))
+	progress := newPullProgress(progressOutput(), images)
+	jobs := make(chan []int)
+	var wg sync.WaitGroup
+	for range min(maxParallelPulls, len(groups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				for _, idx := range group {
+					results[idx], errs[idx] = updateImage(ctx, cli, images[idx], progress.reporter(idx))
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+	progress.finish()
+
+	// still record the images that did update, even if others failed
+	for idx, i := range images {
+		if errs[idx] == nil {
+			checkData[i] = ImageCheck{CheckedAt: results[idx].CheckedAt, Digest: results[idx].Digest}
+		}
+	}
+	return results, errors.Join(append(errs, checkData.write())...)
+}
+
+// updateImage pulls an image if the registry has a different version than the local copy.
+func updateImage(ctx context.Context, cli *client.Client, i ImageDef, report func(status string, notable bool)) (UpdateResult, error) {
+	result := UpdateResult{Image: i.Image, Platform: i.Platform, Status: "current"}
+	report("checking", false)
+	remote, local, err := imageDigests(ctx, cli, i)
+	if err != nil {
+		// the registry can't be asked (such as for local-only images), so fall back to pulling
+		report("could not check registry, pulling instead: "+err.Error(), true)
+	}
+	if remote == "" || remote != local {
+		result.Status = "updated"
+		err = pullImage(ctx, cli, i, report)
+		if err == nil {
+			_, local, err = imageDigests(ctx, cli, i)
 		}
-		err = resp.Close()
 		if err != nil {
+			report("failed: "+err.Error(), true)
+			result.Status = "failed"
+			result.Error = err.Error()
+			return result, fmt.Errorf("updating %s|%s: %w", i.Image, i.Platform, err)
+		}
+		report("updated "+local, true)
+	} else {
+		report("up to date "+local, true)
+	}
+	result.Digest = local
+	result.CheckedAt = time.Now()
+	return result, nil
+}
+
+// imageDigests returns the registry's manifest digest for an image, and the digest of the local copy for the image's
+// platform. The local digest is empty if the image hasn't been pulled (for that platform.)
+func imageDigests(ctx context.Context, cli *client.Client, i ImageDef) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(i.Image)
+	if err != nil {
+		return "", "", err
+	}
+
+	// an image can have several digests for the same repo, such as from pulling both a tag and a pinned digest
+	var locals []string
+	info, err := localImage(ctx, cli, i)
+	if err != nil {
+		return "", "", err
+	}
+	if info != nil {
+		for _, rd := range info.RepoDigests {
+			ref, err := reference.ParseNormalizedNamed(rd)
+			if err != nil {
+				continue
+			}
+			if canonical, ok := ref.(reference.Canonical); ok && ref.Name() == named.Name() {
+				locals = append(locals, canonical.Digest().String())
+			}
+		}
+	}
+	// prefer reporting the digest being compared against, if the image has it
+	localDigest := func(remote string) string {
+		if remote != "" && slices.Contains(locals, remote) {
+			return remote
+		}
+		if len(locals) > 0 {
+			return locals[0]
+		}
+		return ""
+	}
+
+	// a pinned image can't change, so there's no need to ask the registry
+	if canonical, ok := named.(reference.Canonical); ok {
+		remote := canonical.Digest().String()
+		return remote, localDigest(remote), nil
+	}
+
+	dist, err := cli.DistributionInspect(ctx, i.Image, "")
+	if err != nil {
+		return "", localDigest(""), err
+	}
+	remote := dist.Descriptor.Digest.String()
+	return remote, localDigest(remote), nil
+}
+
+// localImage inspects the local copy of an image, returning nil if it hasn't been pulled for the image's platform.
+func localImage(ctx context.Context, cli *client.Client, i ImageDef) (*types.ImageInspect, error) {
+	info, _, err := cli.ImageInspectWithRaw(ctx, i.Image)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !platformMatches(info, i.Platform) {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// imageCreated returns the creation time of the local copy of an image, or the zero time if there isn't one.
+func imageCreated(ctx context.Context, cli *client.Client, i ImageDef) (time.Time, error) {
+	info, err := localImage(ctx, cli, i)
+	if err != nil || info == nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, info.Created)
+}
+
+// platformMatches checks a local image against an os/arch[/variant] platform string. A platform without a variant
+// matches any variant.
+func platformMatches(info types.ImageInspect, platform string) bool {
+	parts := strings.SplitN(platform, "/", 3)
+	if len(parts) < 2 || info.Os != parts[0] || info.Architecture != parts[1] {
+		return false
+	}
+	return len(parts) < 3 || info.Variant == parts[2]
+}
+
+// pullImage pulls an image, reporting a summary of the per-layer progress.
+func pullImage(ctx context.Context, cli *client.Client, i ImageDef, report func(status string, notable bool)) error {
+	resp, err := cli.ImagePull(ctx, i.Image, image.PullOptions{Platform: i.Platform})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	report("pulling", true)
+	layers := make(map[string]*jsonmessage.JSONMessage)
+	var order []string
+	dec := json.NewDecoder(resp)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
 			return err
 		}
-		checkData[i] = time.Now()
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.ID == "" || msg.Progress == nil && msg.Status == "" {
+			continue
+		}
+		if _, ok := layers[msg.ID]; !ok {
+			order = append(order, msg.ID)
+		}
+		layers[msg.ID] = &msg
+		report(layerSummary(layers, order), false)
+	}
+	return resp.Close()
+}
+
+// layerSummary condenses the latest status of each layer of a pull into one line.
+func layerSummary(layers map[string]*jsonmessage.JSONMessage, order []string) string {
+	var done, total int
+	var current, size int64
+	for _, id := range order {
+		msg := layers[id]
+		switch msg.Status {
+		case "Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum", "Download complete", "Extracting":
+			total++
+		case "Pull complete", "Already exists":
+			total++
+			done++
+		default:
+			// not a layer, such as the manifest or a status message
+			continue
+		}
+		if msg.Progress != nil && msg.Status == "Downloading" {
+			current += msg.Progress.Current
+			size += msg.Progress.Total
+		}
+	}
+	summary := fmt.Sprintf("pulling %d/%d layers", done, total)
+	if size > 0 {
+		summary += fmt.Sprintf(", downloading %s/%s", units.HumanSize(float64(current)), units.HumanSize(float64(size)))
 	}
-	return checkData.write()
+	return summary
 }
 
 func getLock() (*os.File, error) {
@@ -122,71 +359,167 @@ func dropLock(file *os.File) error {
 	return os.Remove(file.Name())
 }
 
-// Updates the image for the active (default or specified) profile, and (optionally) all known profiles.
-func checkUpdate(curProfile *Profile, all, force bool) error {
+// Updates the image for the active (default or specified) profile, and (optionally) all known profiles. Built images
+// are only built again if their inputs changed, unless rebuild is set.
+func checkUpdate(ctx context.Context, curProfile *Profile, all, force, rebuild bool) ([]UpdateResult, error) {
 	// Used to de-dupe
 	imagesMap := make(map[ImageDef]bool)
 
 	lock, err := getLock()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	checkData, err := readCheckData()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = dropLock(lock)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	// profiles with a build section have their images built locally instead of pulled
+	results := []UpdateResult{}
+	var buildErr error
+	if curProfile.Build.Context != "" {
+		res, err := buildImage(ctx, cli, curProfile, rebuild)
+		results = append(results, res)
+		buildErr = errors.Join(buildErr, err)
+	}
+
+	// newest minimum_date of any profile using each image
+	minimums := make(map[ImageDef]time.Time)
+	addMinimums := func(profile *Profile) {
+		if profile.MinimumDate.IsZero() {
+			return
+		}
+		for _, i := range imageCandidates(profile) {
+			i = pinnedImage(i)
+			if (all || i.Platform == "linux/"+curProfile.Arch) && profile.MinimumDate.After(minimums[i]) {
+				minimums[i] = profile.MinimumDate
+			}
+		}
+	}
+
 	// add current profile's image
-	for _, i := range checkImageDate(curProfile, checkData, force) {
+	due, err := checkImageDate(ctx, cli, curProfile, checkData, force)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range due {
 		if all || i.Platform == "linux/"+curProfile.Arch {
 			imagesMap[i] = true
 		}
 	}
+	addMinimums(curProfile)
 
 	if all {
-		for _, p := range mergedCfg {
+		for pName, p := range mergedCfg {
 			iface, ok := p.(map[string]interface{})
 			if !ok {
 				continue
 			}
-			prof, err := newProfile(true)
+			prof, err := resolveImageProfile(pName, iface)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			// we want defaults but NOT the defaults for images
-			prof.ImageAMD64 = ""
-			prof.ImageARM64 = ""
-			prof.ImageARM = ""
-			prof.ImageARMv6 = ""
-			prof.Image386 = ""
-			prof.Image = ""
+			if prof.Build.Context != "" && pName != curProfile.name {
+				arches := prof.Build.Platforms
+				if len(arches) == 0 {
+					arches = []string{prof.Arch}
+				}
+				for _, arch := range arches {
+					archProf := *prof
+					archProf.Arch = arch
+					res, err := buildImage(ctx, cli, &archProf, rebuild)
+					results = append(results, res)
+					buildErr = errors.Join(buildErr, err)
+				}
+			}
 
-			err = mapDecode(iface, prof)
+			due, err := checkImageDate(ctx, cli, prof, checkData, force)
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-			for _, i := range checkImageDate(prof, checkData, force) {
+			for _, i := range due {
 				imagesMap[i] = true
 			}
+			addMinimums(prof)
 		}
 	}
 
 	var images []ImageDef
 	for i := range imagesMap {
-		fmt.Printf("queuing update: %s|%s\n", i.Image, i.Platform)
 		images = append(images, i)
 	}
+	slices.SortFunc(images, func(a, b ImageDef) int {
+		return strings.Compare(a.Image+"|"+a.Platform, b.Image+"|"+b.Platform)
+	})
+
+	pulled, err := update(ctx, images...)
+	results = append(results, pulled...)
+	err = errors.Join(buildErr, err)
+
+	// if even the registry's image is too old, using it would defeat the point of minimum_date
+	for i, minimum := range minimums {
+		created, err2 := imageCreated(ctx, cli, i)
+		if err2 != nil {
+			err = errors.Join(err, err2)
+		} else if !created.IsZero() && created.Before(minimum) {
+			err = errors.Join(err, &minimumDateError{image: i, created: created, minimum: minimum})
+		}
+	}
+	return results, err
+}
+
+// minimumDateError is returned when the newest available image is older than a profile's minimum_date.
+type minimumDateError struct {
+	image   ImageDef
+	created time.Time
+	minimum time.Time
+}
+
+func (e *minimumDateError) Error() string {
+	return fmt.Sprintf("image %s|%s was created %s, which is older than the profile's minimum_date of %s, even after updating; "+
+		"the registry may not have the required image yet",
+		e.image.Image, e.image.Platform, e.created.Format(time.RFC3339), e.minimum.Format(time.RFC3339))
+}
+
+// resolveImageProfile merges a profile from the config for finding its images, which (unlike other settings) don't
+// fall back to the builtin defaults.
+func resolveImageProfile(name string, iface map[string]interface{}) (*Profile, error) {
+	prof, err := newProfile(true)
+	if err != nil {
+		return nil, err
+	}
 
-	return update(images...)
+	// we want defaults but NOT the defaults for images
+	prof.ImageAMD64 = ""
+	prof.ImageARM64 = ""
+	prof.ImageARM = ""
+	prof.ImageARMv6 = ""
+	prof.Image386 = ""
+	prof.Image = ""
+	// the defaults were already merged, but must be merged again for their own images (such as when name is defaults)
+	prof.chain = nil
+
+	prof.name = name
+	return prof, mergeProfile(name, iface, prof)
 }
 
-func checkImageDate(profile *Profile, checkData ImageCheckData, force bool) []ImageDef {
-	var imageCandidates, images []ImageDef
+// imageCandidates lists the images (per platform) a profile can use.
+func imageCandidates(profile *Profile) []ImageDef {
+	var imageCandidates []ImageDef
+
+	// built images are local only
+	if profile.Build.Context != "" {
+		return nil
+	}
 
 	// multi arch profiles
 	if profile.ImageAMD64 != "" {
@@ -207,14 +540,31 @@ func checkImageDate(profile *Profile, checkData ImageCheckData, force bool) []Im
 	if profile.Image != "" {
 		imageCandidates = append(imageCandidates, ImageDef{Image: profile.Image, Platform: "linux/" + profile.Arch})
 	}
+	return imageCandidates
+}
 
-	for _, i := range imageCandidates {
-		lastUpdate, ok := checkData[i]
-		if !ok || force || time.Now().After(lastUpdate.Add(profile.UpdateInterval)) || profile.MinimumDate.After(lastUpdate) {
+// checkImageDate returns the profile's images that are due for an update check, either because update_interval has
+// passed, or because the local image was created before the profile's minimum_date.
+func checkImageDate(ctx context.Context, cli *client.Client, profile *Profile, checkData ImageCheckData, force bool) ([]ImageDef, error) {
+	var images []ImageDef
+	for _, i := range imageCandidates(profile) {
+		i = pinnedImage(i)
+		lastCheck, ok := checkData[i]
+		if !ok || force || time.Now().After(lastCheck.CheckedAt.Add(profile.UpdateInterval)) {
 			images = append(images, i)
+			continue
+		}
+		if !profile.MinimumDate.IsZero() {
+			created, err := imageCreated(ctx, cli, i)
+			if err != nil {
+				return nil, err
+			}
+			if created.Before(profile.MinimumDate) {
+				images = append(images, i)
+			}
 		}
 	}
-	return images
+	return images, nil
 }
 
 func readCheckData() (ImageCheckData, error) {
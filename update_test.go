@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"gopkg.in/yaml.v3"
+)
+
+func TestImageCheckUnmarshal(t *testing.T) {
+	checked := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		data string
+		want ImageCheck
+	}{
+		{
+			name: "plain timestamp from older versions",
+			data: "alpine|linux/amd64: 2024-05-01T12:00:00Z\n",
+			want: ImageCheck{CheckedAt: checked},
+		},
+		{
+			name: "with digest",
+			data: "alpine|linux/amd64:\n  checked_at: 2024-05-01T12:00:00Z\n  digest: sha256:abc\n",
+			want: ImageCheck{CheckedAt: checked, Digest: "sha256:abc"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make(ImageCheckData)
+			if err := yaml.Unmarshal([]byte(tc.data), &data); err != nil {
+				t.Fatal(err)
+			}
+			got := data[ImageDef{Image: "alpine", Platform: "linux/amd64"}]
+			if !got.CheckedAt.Equal(tc.want.CheckedAt) || got.Digest != tc.want.Digest {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	tests := []struct {
+		os, arch, variant string
+		platform          string
+		want              bool
+	}{
+		{"linux", "amd64", "", "linux/amd64", true},
+		{"linux", "arm64", "v8", "linux/arm64", true},
+		{"linux", "arm", "v6", "linux/arm/v6", true},
+		{"linux", "arm", "v7", "linux/arm/v6", false},
+		{"linux", "arm64", "", "linux/amd64", false},
+		{"windows", "amd64", "", "linux/amd64", false},
+		{"linux", "amd64", "", "amd64", false},
+	}
+	for _, tc := range tests {
+		info := types.ImageInspect{Os: tc.os, Architecture: tc.arch, Variant: tc.variant}
+		if got := platformMatches(info, tc.platform); got != tc.want {
+			t.Errorf("platformMatches(%s/%s/%s, %s) = %v, want %v", tc.os, tc.arch, tc.variant, tc.platform, got, tc.want)
+		}
+	}
+}
+
+// TestRegistryDigests checks update's digest comparison against a real registry. It's only run when
+// CANON_TEST_REGISTRY is set to the address of a registry that images can be pushed to, such as one started with
+// "docker run -d -p 5000:5000 registry:2" (for which CANON_TEST_REGISTRY=localhost:5000.)
+func TestRegistryDigests(t *testing.T) {
+	registry := os.Getenv("CANON_TEST_REGISTRY")
+	if registry == "" {
+		t.Skip("CANON_TEST_REGISTRY not set")
+	}
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform := "linux/" + runtime.GOARCH
+	noReport := func(string, bool) {}
+
+	// push a test image, then remove the local copy, so it looks like a new image in the registry
+	if err := pullImage(ctx, cli, ImageDef{Image: "busybox:latest", Platform: platform}, noReport); err != nil {
+		t.Fatal(err)
+	}
+	i := ImageDef{Image: registry + "/canon-test:latest", Platform: platform}
+	if err := cli.ImageTag(ctx, "busybox:latest", i.Image); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cli.ImagePush(ctx, i.Image, image.PushOptions{RegistryAuth: "e30="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jsonmessage.DisplayJSONMessagesStream(resp, io.Discard, 0, false, nil)
+	resp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeTestImage := func() {
+		if _, err := cli.ImageRemove(ctx, i.Image, image.RemoveOptions{}); err != nil {
+			t.Log(err)
+		}
+	}
+	removeTestImage()
+	t.Cleanup(removeTestImage)
+
+	remote, local, err := imageDigests(ctx, cli, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote == "" || local != "" {
+		t.Fatalf("before pulling, got remote %q and local %q, want only remote", remote, local)
+	}
+
+	result, err := updateImage(ctx, cli, i, noReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "updated" || result.Digest != remote {
+		t.Fatalf("first update got status %s digest %s, want updated %s", result.Status, result.Digest, remote)
+	}
+	result, err = updateImage(ctx, cli, i, noReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "current" || result.Digest != remote {
+		t.Fatalf("second update got status %s digest %s, want current %s", result.Status, result.Digest, remote)
+	}
+
+	// a pinned image is compared against its own digest, without asking the registry
+	pinned := ImageDef{Image: registry + "/canon-test@" + remote, Platform: platform}
+	pinnedRemote, pinnedLocal, err := imageDigests(ctx, cli, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinnedRemote != remote || pinnedLocal != remote {
+		t.Errorf("pinned image got remote %q and local %q, want both %q", pinnedRemote, pinnedLocal, remote)
+	}
+}
+
+func TestResolveImageProfile(t *testing.T) {
+	setMergedCfg(t, map[string]interface{}{
+		"defaults": map[string]interface{}{"image": "alpine", "user": "builder"},
+		"plain":    map[string]interface{}{"path": "/src"},
+		"own":      map[string]interface{}{"image_arm64": "arm-image"},
+		"extender": map[string]interface{}{"extends": []interface{}{"defaults"}},
+	})
+	tests := []struct {
+		name      string
+		wantImage string
+		wantARM64 string
+	}{
+		// images set only in defaults must still be found for the defaults entry itself
+		{name: "defaults", wantImage: "alpine"},
+		{name: "plain"},
+		{name: "own", wantARM64: "arm-image"},
+		{name: "extender", wantImage: "alpine"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prof, err := resolveImageProfile(tc.name, mergedCfg[tc.name].(map[string]interface{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prof.Image != tc.wantImage || prof.ImageARM64 != tc.wantARM64 {
+				t.Errorf("got image %q arm64 %q, want %q and %q", prof.Image, prof.ImageARM64, tc.wantImage, tc.wantARM64)
+			}
+			if prof.User != "builder" {
+				t.Errorf("got user %q, want the default builder", prof.User)
+			}
+		})
+	}
+}
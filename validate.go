@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+// profileFields returns the config key names of all profile fields, in struct order.
+func profileFields() []string {
+	var fields []string
+	t := reflect.TypeOf(Profile{})
+	for i := range t.NumField() {
+		if tag := t.Field(i).Tag.Get("mapstructure"); tag != "" {
+			fields = append(fields, tag)
+		}
+	}
+	return fields
+}
+
+// validateConfigs checks every loaded config file, printing each problem found with its location.
+func validateConfigs() error {
+	var problems []string
+	for _, path := range loadedCfgFiles {
+		problems = append(problems, validateConfigFile(path)...)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) in config", len(problems))
+	}
+	fmt.Printf("No problems found in %d config file(s)\n", len(loadedCfgFiles))
+	return nil
+}
+
+func validateConfigFile(path string) []string {
+	cfgData, err := os.ReadFile(path)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(cfgData, &doc); err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	top := doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return []string{fmt.Sprintf("%s:%d: config must be a map of profiles", path, top.Line)}
+	}
+
+	var problems []string
+	problem := func(line int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s:%d: %s", path, line, fmt.Sprintf(format, args...)))
+	}
+
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, val := top.Content[i], top.Content[i+1]
+		switch key.Value {
+		case "include":
+			if val.Kind == yaml.ScalarNode {
+				continue
+			}
+			if val.Kind != yaml.SequenceNode {
+				problem(val.Line, "include must be a path or list of paths")
+				continue
+			}
+			for _, inc := range val.Content {
+				if inc.Kind != yaml.ScalarNode {
+					problem(inc.Line, "include entries must be paths")
+				}
+			}
+		case "root":
+			if val.Kind != yaml.ScalarNode || val.Tag != "!!bool" {
+				problem(val.Line, "root must be true or false")
+			}
+		default:
+			if val.Kind != yaml.MappingNode {
+				problem(key.Line, "%s is not a profile (expected a map of settings)", key.Value)
+				continue
+			}
+			for _, p := range validateProfileNode(key.Value, val) {
+				problem(p.line, "profile %s: %s", key.Value, p.msg)
+			}
+		}
+	}
+	return problems
+}
+
+type profileProblem struct {
+	line int
+	msg  string
+}
+
+func validateProfileNode(name string, node *yaml.Node) []profileProblem {
+	var problems []profileProblem
+	known := make(map[string]bool)
+	for _, f := range profileFields() {
+		known[f] = true
+	}
+
+	// decode one key at a time, so errors can be tied to a line
+	prof := &Profile{}
+	lines := make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		lines[key.Value] = key.Line
+		if name == "defaults" && key.Value == "profile" {
+			if val.Kind != yaml.ScalarNode {
+				problems = append(problems, profileProblem{key.Line, "profile must be a profile name"})
+			}
+			continue
+		}
+		if !known[key.Value] {
+			problems = append(problems, profileProblem{key.Line, fmt.Sprintf("unknown field %q", key.Value)})
+			continue
+		}
+
+		var raw interface{}
+		if err := val.Decode(&raw); err != nil {
+			problems = append(problems, profileProblem{key.Line, err.Error()})
+			continue
+		}
+		if err := mapDecodeStrict(map[string]interface{}{key.Value: raw}, prof); err != nil {
+			var decErr *mapstructure.Error
+			if errors.As(err, &decErr) {
+				err = errors.New(strings.Join(decErr.Errors, "; "))
+			}
+			problems = append(problems, profileProblem{key.Line, err.Error()})
+			lines[key.Value] = 0
+		}
+	}
+
+	// semantic checks, only for fields that were set and decoded cleanly
+	check := func(field string, err error) {
+		if line := lines[field]; line != 0 && err != nil {
+			problems = append(problems, profileProblem{line, err.Error()})
+		}
+	}
+
+	check("arch", validateArch(prof.Arch))
+	for field, img := range map[string]string{
+		"image":        prof.Image,
+		"image_amd64":  prof.ImageAMD64,
+		"image_386":    prof.Image386,
+		"image_arm64":  prof.ImageARM64,
+		"image_arm":    prof.ImageARM,
+		"image_arm_v6": prof.ImageARMv6,
+	} {
+		if _, err := reference.ParseNormalizedNamed(img); err != nil {
+			check(field, fmt.Errorf("invalid image reference %q: %w", img, err))
+		}
+	}
+	if prof.UpdateInterval < 0 {
+		check("update_interval", errors.New("update_interval cannot be negative"))
+	}
+	if prof.IdleTimeout < 0 {
+		check("idle_timeout", errors.New("idle_timeout cannot be negative"))
+	}
+	if prof.SetupTimeout < 0 {
+		check("setup_timeout", errors.New("setup_timeout cannot be negative"))
+	}
+	for _, pattern := range prof.PassEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			check("pass_env", fmt.Errorf("invalid pattern %q: %w", pattern, err))
+		}
+	}
+	check("recreate_on_change", validateRecreateOnChange(prof.RecreateOnChange))
+	check("mounts", validateMounts(prof.Mounts))
+	check("caches", validateCaches(prof.Caches))
+	check("build", validateBuild(prof.Build))
+	for _, parent := range prof.Extends {
+		if _, ok := mergedCfg[parent].(map[string]interface{}); !ok {
+			check("extends", fmt.Errorf("extends unknown profile %s", parent))
+		}
+	}
+	slices.SortStableFunc(problems, func(a, b profileProblem) int { return a.line - b.line })
+	return problems
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name: "valid",
+			config: `defaults:
+  profile: base
+base:
+  image: alpine
+  arch: arm64
+child:
+  extends: [base]
+  pass_env: ["GO*"]
+`,
+		},
+		{
+			name:   "empty",
+			config: "",
+		},
+		{
+			name:   "not a map",
+			config: "- a\n- b\n",
+			want:   []string{":1: config must be a map of profiles"},
+		},
+		{
+			name: "problems on their own lines",
+			config: `base:
+  image: alpine
+  arch: sparc
+  unknown: 1
+  update_interval: -1h
+  persistent: maybe
+other: 3
+`,
+			want: []string{
+				`:3: profile base: Invalid architecture: sparc`,
+				`:4: profile base: unknown field "unknown"`,
+				`:5: profile base: update_interval cannot be negative`,
+				`:6: profile base: 'persistent' expected type 'bool', got unconvertible type 'string', value: 'maybe'`,
+				`:7: other is not a profile (expected a map of settings)`,
+			},
+		},
+		{
+			name: "include and root",
+			config: `root: yes please
+include:
+  - a.yaml
+  - [b.yaml]
+`,
+			want: []string{
+				":1: root must be true or false",
+				":4: include entries must be paths",
+			},
+		},
+		{
+			name: "extends unknown profile",
+			config: `child:
+  image: alpine
+  extends: [missing]
+`,
+			want: []string{":3: profile child: extends unknown profile missing"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setMergedCfg(t, map[string]interface{}{"base": map[string]interface{}{}})
+			path := filepath.Join(t.TempDir(), ".canon.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, w := range tc.want {
+				want = append(want, path+w)
+			}
+			if got := validateConfigFile(path); !slices.Equal(got, want) {
+				t.Errorf("got problems:\n%q\nwant:\n%q", got, want)
+			}
+		})
+	}
+}